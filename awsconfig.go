@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// loadAWSConfig loads the default AWS config, from the -profile of the shared config files when set,
+// with the static -accesskey credentials when set and overriding the region with -region when set
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	if (accessKey == "") != (secretKey == "") {
+		return aws.Config{}, errors.New("-accesskey and -secretkey must be set together")
+	} else if sessionToken != "" && accessKey == "" {
+		return aws.Config{}, errors.New("-sessiontoken needs the -accesskey and -secretkey it belongs to")
+	} else if accessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, sessionToken)))
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	return config.LoadDefaultConfig(ctx, opts...)
+}
+
+// newRoute53Client creates the Route53 client from the task's config, replaced by a mock in tests
+var newRoute53Client = func(cfg aws.Config) route53API {
+	return route53.NewFromConfig(route53Config(cfg))
+}
+
+// route53Config returns the config for the Route53 client, using the -assumerole credentials and -endpoint when set.
+// The metadata clients keep using cfg so they run with the task's own identity.
+func route53Config(cfg aws.Config) aws.Config {
+	r53cfg := cfg.Copy()
+	if endpoint != "" {
+		r53cfg.BaseEndpoint = aws.String(endpoint)
+	}
+	if assumeRole == "" {
+		return r53cfg
+	}
+
+	stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	provider := stscreds.NewAssumeRoleProvider(stsClient, assumeRole, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = "route53-sidecar"
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+	r53cfg.Credentials = aws.NewCredentialsCache(provider)
+	return r53cfg
+}
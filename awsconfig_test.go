@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+func Test_route53Config(t *testing.T) {
+	defer func() { assumeRole, externalID = "", "" }()
+
+	base := aws.Config{
+		Region:      "us-west-2",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+
+	got := route53Config(base)
+	if got.Credentials != base.Credentials {
+		t.Errorf("route53Config() without -assumerole changed the credentials provider")
+	}
+
+	assumeRole = "arn:aws:iam::123456789012:role/dns"
+	externalID = "ext-123"
+	got = route53Config(base)
+	cache, ok := got.Credentials.(*aws.CredentialsCache)
+	if !ok {
+		t.Fatalf("route53Config() credentials = %T, want *aws.CredentialsCache", got.Credentials)
+	}
+	if !cache.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Errorf("route53Config() credentials do not use the assume role provider")
+	}
+	if base.Credentials == got.Credentials {
+		t.Errorf("route53Config() modified the base config credentials")
+	}
+}
+
+func Test_loadAWSConfigProfile(t *testing.T) {
+	// The run() tests leave -region and the static credentials set, they would override the profile
+	defer func(p, r, k, s, st string) {
+		profile, region, accessKey, secretKey, sessionToken = p, r, k, s, st
+	}(profile, region, accessKey, secretKey, sessionToken)
+	region, accessKey, secretKey, sessionToken = "", "", "", ""
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config")
+	credentialsPath := filepath.Join(dir, "credentials")
+	os.WriteFile(configPath, []byte("[default]\nregion = us-east-1\n\n[profile dns]\nregion = eu-west-3\n"), 0o600)
+	os.WriteFile(credentialsPath, []byte("[default]\naws_access_key_id = DEFAULT\naws_secret_access_key = SECRET\n\n[dns]\naws_access_key_id = DNS\naws_secret_access_key = SECRET\n"), 0o600)
+	t.Setenv("AWS_CONFIG_FILE", configPath)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsPath)
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	for _, tt := range []struct {
+		profile, wantRegion, wantKey string
+	}{
+		{"", "us-east-1", "DEFAULT"},
+		{"dns", "eu-west-3", "DNS"},
+	} {
+		profile = tt.profile
+		cfg, err := loadAWSConfig(context.Background())
+		if err != nil {
+			t.Fatalf("loadAWSConfig() with profile %q error = %v", tt.profile, err)
+		}
+		if cfg.Region != tt.wantRegion {
+			t.Errorf("loadAWSConfig() with profile %q region = %v, want %v", tt.profile, cfg.Region, tt.wantRegion)
+		}
+		creds, err := cfg.Credentials.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("Retrieve() with profile %q error = %v", tt.profile, err)
+		}
+		if creds.AccessKeyID != tt.wantKey {
+			t.Errorf("loadAWSConfig() with profile %q access key = %v, want %v", tt.profile, creds.AccessKeyID, tt.wantKey)
+		}
+	}
+}
+
+func Test_loadAWSConfigStaticCredentials(t *testing.T) {
+	defer func() { accessKey, secretKey, sessionToken = "", "", "" }()
+	t.Setenv("AWS_ACCESS_KEY_ID", "FROMENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	accessKey, secretKey, sessionToken = "STATIC", "STATICSECRET", "TOKEN"
+	cfg, err := loadAWSConfig(context.Background())
+	if err != nil {
+		t.Fatalf("loadAWSConfig() error = %v", err)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if creds.AccessKeyID != "STATIC" || creds.SecretAccessKey != "STATICSECRET" || creds.SessionToken != "TOKEN" || creds.Source != credentials.StaticCredentialsName {
+		t.Errorf("Retrieve() = %s/%s from %s, want the static -accesskey over the default chain", creds.AccessKeyID, creds.SessionToken, creds.Source)
+	}
+
+	accessKey, secretKey, sessionToken = "STATIC", "", ""
+	if _, err := loadAWSConfig(context.Background()); err == nil {
+		t.Error("loadAWSConfig() without -secretkey error = nil, want an error")
+	}
+}
+
+func Test_route53ConfigEndpoint(t *testing.T) {
+	defer func() { endpoint = "" }()
+
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<GetChangeResponse><ChangeInfo><Id>/change/C123</Id><Status>INSYNC</Status></ChangeInfo></GetChangeResponse>`))
+	}))
+	defer server.Close()
+
+	endpoint = server.URL
+	cfg := route53Config(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+	if got := aws.ToString(cfg.BaseEndpoint); got != server.URL {
+		t.Fatalf("BaseEndpoint = %v, want %v", got, server.URL)
+	}
+
+	output, err := route53.NewFromConfig(cfg).GetChange(context.Background(), &route53.GetChangeInput{Id: aws.String("C123")})
+	if err != nil {
+		t.Fatalf("GetChange() error = %v", err)
+	}
+	if gotPath != "/2013-04-01/change/C123" {
+		t.Errorf("request path = %v, want /2013-04-01/change/C123", gotPath)
+	}
+	if output.ChangeInfo.Status != types.ChangeStatusInsync {
+		t.Errorf("Status = %v, want %v", output.ChangeInfo.Status, types.ChangeStatusInsync)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+// configDump is the effective configuration after the config file, environment and flags are resolved,
+// logged as a single line with -logformat json so it can be parsed when debugging a deployment
+type configDump struct {
+	Version              string         `json:"version"`
+	DNS                  []string       `json:"dns"`
+	DomainSuffix         string         `json:"domainSuffix,omitempty"`
+	TTL                  int            `json:"ttl"`
+	TTLs                 map[string]int `json:"ttls,omitempty"`
+	MinTTL               int            `json:"minTTL,omitempty"`
+	RejectLowTTL         bool           `json:"rejectLowTTL"`
+	RecordType           string         `json:"recordType"`
+	RoutingPolicy        string         `json:"routingPolicy"`
+	Weight               int64          `json:"weight"`
+	WeightSource         string         `json:"weightSource"`
+	Region               string         `json:"region,omitempty"`
+	Profile              string         `json:"profile,omitempty"`
+	AccessKey            string         `json:"accessKey,omitempty"`
+	Geo                  string         `json:"geo,omitempty"`
+	VPCCheck             string         `json:"vpcCheck"`
+	IdentifierCheck      string         `json:"identifierCheck"`
+	LeaderLock           string         `json:"leaderLock,omitempty"`
+	LeaderKey            string         `json:"leaderKey,omitempty"`
+	LeaderLease          string         `json:"leaderLease,omitempty"`
+	VPCID                string         `json:"vpcId,omitempty"`
+	AssumeRole           string         `json:"assumeRole,omitempty"`
+	Endpoint             string         `json:"endpoint,omitempty"`
+	Target               string         `json:"target,omitempty"`
+	SRVPriority          int            `json:"srvPriority,omitempty"`
+	SRVWeight            int            `json:"srvWeight,omitempty"`
+	SRVPort              int            `json:"srvPort,omitempty"`
+	AliasTarget          string         `json:"aliasTarget,omitempty"`
+	AliasZone            string         `json:"aliasZone,omitempty"`
+	EvaluateTargetHealth bool           `json:"evaluateTargetHealth"`
+	TXTValue             string         `json:"txtValue,omitempty"`
+	Comment              string         `json:"comment,omitempty"`
+	Webhook              string         `json:"webhook,omitempty"`
+	DeleteStale          bool           `json:"deleteStale"`
+	OverwriteConflicting bool           `json:"overwriteConflicting"`
+	SkipUnchanged        bool           `json:"skipUnchanged"`
+	SplitInvalidBatch    bool           `json:"splitInvalidBatch"`
+	DeleteFetched        bool           `json:"deleteFetched"`
+	DryRun               bool           `json:"dryRun"`
+	Output               string         `json:"output"`
+	Wait                 bool           `json:"wait"`
+	SkipTTLWait          bool           `json:"skipTTLWait"`
+	WaitRemainingTTL     bool           `json:"waitRemainingTTL"`
+	FastTeardown         bool           `json:"fastTeardown"`
+	NoTeardown           bool           `json:"noTeardown"`
+	SkipZoneCheck        bool           `json:"skipZoneCheck"`
+	SetupDelay           string         `json:"setupDelay"`
+	StartupJitter        string         `json:"startupJitter"`
+	WaitForPort          string         `json:"waitForPort,omitempty"`
+	WaitForPortTimeout   string         `json:"waitForPortTimeout"`
+	ReadyTimeout         string         `json:"readyTimeout"`
+	RegisterUnready      bool           `json:"registerUnready"`
+	RefreshInterval      string         `json:"refreshInterval"`
+	IPRefresh            bool           `json:"ipRefresh"`
+	DualStack            bool           `json:"dualStack"`
+	IPCIDR               string         `json:"ipCidr,omitempty"`
+	Container            string         `json:"container,omitempty"`
+	IMDSTimeout          string         `json:"imdsTimeout"`
+	ECSTimeout           string         `json:"ecsTimeout"`
+	MetadataRetries      int            `json:"metadataRetries"`
+	StopPollInterval     string         `json:"stopPollInterval"`
+	SyncPollInterval     string         `json:"syncPollInterval"`
+	SyncPollMax          string         `json:"syncPollMax"`
+	SyncTimeout          string         `json:"syncTimeout"`
+	SyncMaxFailures      int            `json:"syncMaxFailures"`
+	APITimeout           string         `json:"apiTimeout"`
+	MaxRetries           int            `json:"maxRetries"`
+	RetryBaseDelay       string         `json:"retryBaseDelay"`
+	HealthPort           int            `json:"healthPort,omitempty"`
+	MetricsPort          int            `json:"metricsPort,omitempty"`
+	LogLevel             string         `json:"logLevel"`
+	LogFormat            string         `json:"logFormat"`
+	Quiet                bool           `json:"quiet"`
+	Zones                []zoneDump     `json:"zones"`
+}
+
+// zoneDump is the part of the configuration that differs per hosted zone
+type zoneDump struct {
+	HostedZone    string   `json:"hostedZone"`
+	IPSource      string   `json:"ipSource,omitempty"`
+	IPAddress     string   `json:"ipAddress,omitempty"`
+	ExtraIPs      []string `json:"extraIpAddresses,omitempty"`
+	IPv6Address   string   `json:"ipv6Address,omitempty"`
+	SetIdentifier string   `json:"setIdentifier,omitempty"`
+	StateFile     string   `json:"stateFile,omitempty"`
+}
+
+// ipSourceName is the -ipaddress value of src, "" for none
+func ipSourceName(src IPSource) string {
+	if src == nil {
+		return ""
+	}
+	return src.String()
+}
+
+func newConfigDump(rs registrars) configDump {
+	r := rs[0] // the zones only differ in the fields of zoneDump
+	dump := configDump{
+		Version:              version,
+		DNS:                  r.Names,
+		DomainSuffix:         domainSuffix,
+		TTL:                  r.TTL,
+		TTLs:                 r.TTLs,
+		MinTTL:               r.MinTTL,
+		RejectLowTTL:         rejectLowTTL,
+		RecordType:           string(r.RecordType),
+		RoutingPolicy:        r.RoutingPolicy,
+		Weight:               r.Weight,
+		WeightSource:         weightSource,
+		Region:               region,
+		Profile:              profile,
+		AccessKey:            accessKey,
+		Geo:                  geo,
+		VPCCheck:             vpcCheck,
+		IdentifierCheck:      identifierCheck,
+		LeaderLock:           leaderLock,
+		LeaderKey:            leaderKey,
+		LeaderLease:          leaderLease.String(),
+		VPCID:                vpcID,
+		AssumeRole:           assumeRole,
+		Endpoint:             endpoint,
+		Target:               r.Target,
+		SRVPriority:          r.SRVPriority,
+		SRVWeight:            r.SRVWeight,
+		SRVPort:              r.SRVPort,
+		AliasTarget:          r.AliasTarget,
+		AliasZone:            r.AliasZone,
+		EvaluateTargetHealth: r.EvaluateTargetHealth,
+		TXTValue:             r.TXTValue,
+		Comment:              r.Comment,
+		Webhook:              redactURL(r.Webhook),
+		DeleteStale:          r.DeleteStale,
+		OverwriteConflicting: r.OverwriteConflicting,
+		SkipUnchanged:        r.SkipUnchanged,
+		SplitInvalidBatch:    r.SplitInvalidBatch,
+		DeleteFetched:        r.DeleteFetched,
+		DryRun:               r.DryRun,
+		Output:               output,
+		Wait:                 r.Wait,
+		SkipTTLWait:          r.SkipTTLWait,
+		WaitRemainingTTL:     r.WaitRemainingTTL,
+		FastTeardown:         r.FastTeardown,
+		NoTeardown:           r.NoTeardown,
+		SkipZoneCheck:        skipZoneCheck,
+		SetupDelay:           r.SetupDelay.String(),
+		StartupJitter:        r.StartupJitter.String(),
+		WaitForPort:          r.WaitForPort,
+		WaitForPortTimeout:   r.WaitForPortTimeout.String(),
+		ReadyTimeout:         r.ReadyTimeout.String(),
+		RegisterUnready:      r.RegisterUnready,
+		RefreshInterval:      r.RefreshInterval.String(),
+		IPRefresh:            ipRefresh,
+		DualStack:            dualStack,
+		IPCIDR:               ipCIDR,
+		Container:            container,
+		IMDSTimeout:          imdsTimeout.String(),
+		ECSTimeout:           ecsTimeout.String(),
+		MetadataRetries:      metadataRetries,
+		StopPollInterval:     stopPoll.String(),
+		SyncPollInterval:     r.SyncPollInterval.String(),
+		SyncPollMax:          r.SyncPollMax.String(),
+		SyncTimeout:          r.SyncTimeout.String(),
+		SyncMaxFailures:      r.SyncMaxFailures,
+		APITimeout:           r.APITimeout.String(),
+		MaxRetries:           r.MaxRetries,
+		RetryBaseDelay:       r.RetryBaseDelay.String(),
+		HealthPort:           healthPort,
+		MetricsPort:          metricsPort,
+		LogLevel:             logLevel,
+		LogFormat:            logFormat,
+		Quiet:                quiet,
+	}
+	for _, r := range rs {
+		dump.Zones = append(dump.Zones, zoneDump{
+			HostedZone:    r.HostedZone,
+			IPSource:      ipSourceName(r.IPSource),
+			IPAddress:     r.IPAddress,
+			ExtraIPs:      r.ExtraIPAddresses,
+			IPv6Address:   r.IPv6Address,
+			SetIdentifier: r.recordSetIdentifier(),
+			StateFile:     r.StateFile,
+		})
+	}
+	return dump
+}
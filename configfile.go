@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/namsral/flag"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile applies the keys of a YAML (or JSON) file to the flags not already set from
+// the command line or environment, giving the precedence flags > env > file > defaults
+func loadConfigFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.ToLower(key)
+		if name == "config" || flag.Lookup(name) == nil {
+			log.Warnf("Ignoring unknown key %q in config file %s", key, path)
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, configValue(values[key])); err != nil {
+			return fmt.Errorf("invalid value for %q in %s: %w", key, path, err)
+		}
+	}
+	return nil
+}
+
+// configValue formats a config file value as a flag value, lists become comma separated
+func configValue(value any) string {
+	if list, ok := value.([]any); ok {
+		parts := make([]string, len(list))
+		for i, v := range list {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(value)
+}
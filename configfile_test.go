@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+func Test_loadConfigFile(t *testing.T) {
+	resetFlagsAfter(t)
+
+	path := filepath.Join(t.TempDir(), "sidecar.yaml")
+	config := `
+dns:
+  - a.example.com
+  - b.example.com
+DNSTTL: 60
+weight: 5
+dryrun: true
+setupdelay: 3s
+notaflag: ignored
+`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEIGHT", "7")
+
+	flag.CommandLine = flag.NewFlagSet("route53-sidecar", flag.ContinueOnError)
+	defineFlags()
+	if err := flag.CommandLine.Parse([]string{"-dnsttl=30"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+
+	if dns != "a.example.com,b.example.com" {
+		t.Errorf("dns = %q, want the list from the file", dns)
+	}
+	if dnsTTL != 30 {
+		t.Errorf("dnsTTL = %d, want 30 from the flag", dnsTTL)
+	}
+	if weight != 7 {
+		t.Errorf("weight = %d, want 7 from the environment", weight)
+	}
+	if !dryRun {
+		t.Errorf("dryRun = false, want true from the file")
+	}
+	if setupDelay != 3*time.Second {
+		t.Errorf("setupDelay = %v, want 3s from the file", setupDelay)
+	}
+}
+
+func Test_loadConfigFileJSON(t *testing.T) {
+	resetFlagsAfter(t)
+
+	path := filepath.Join(t.TempDir(), "sidecar.json")
+	if err := os.WriteFile(path, []byte(`{"hostedzone": "Z123", "dnsttl": "abc"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.CommandLine = flag.NewFlagSet("route53-sidecar", flag.ContinueOnError)
+	defineFlags()
+	if err := flag.CommandLine.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err == nil {
+		t.Error("loadConfigFile() error = nil, want error for invalid dnsttl")
+	}
+}
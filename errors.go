@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+)
+
+// Kinds of errors returned by the Registrar and the startup checks, matched with errors.Is.
+// The error of the AWS SDK stays wrapped, so errors.As still finds e.g. the *types.InvalidChangeBatch.
+var (
+	errRecordConflict     = errors.New("DNS record conflicts with an existing record")
+	errPropagationTimeout = errors.New("DNS change not propagated in time")
+	errHostedZoneNotFound = errors.New("hosted zone not found")
+	errAccessDenied       = errors.New("access denied")
+)
+
+// kindError tags err with one of the error kinds above without changing its message
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+// withKind tags err with kind, a nil err stays nil
+func withKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind, err}
+}
+
+// classifyAPIError tags a Route53 error with its kind, other errors are returned as they are
+func classifyAPIError(err error) error {
+	var noSuchZone *types.NoSuchHostedZone
+	switch {
+	case err == nil:
+		return nil
+	case isConflictError(err):
+		return withKind(errRecordConflict, err)
+	case errors.As(err, &noSuchZone):
+		return withKind(errHostedZoneNotFound, err)
+	case isAccessDenied(err):
+		return withKind(errAccessDenied, err)
+	}
+	return err
+}
+
+// isAccessDenied reports whether AWS rejected the call for missing IAM permissions
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "AccessDenied" || apiErr.ErrorCode() == "AccessDeniedException")
+}
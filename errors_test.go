@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+)
+
+func Test_classifyAPIError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"conflict", &types.InvalidChangeBatch{Message: aws.String("conflicting RRSet of type CNAME")}, errRecordConflict},
+		{"no such zone", &types.NoSuchHostedZone{Message: aws.String("No hosted zone found with ID: Z123")}, errHostedZoneNotFound},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDenied"}, errAccessDenied},
+		{"wrapped", fmt.Errorf("retries exhausted: %w", &smithy.GenericAPIError{Code: "AccessDenied"}), errAccessDenied},
+		{"other", &types.InvalidInput{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyAPIError(tt.err)
+			if got.Error() != tt.err.Error() {
+				t.Errorf("classifyAPIError() = %q, want the message unchanged", got)
+			}
+			for _, kind := range []error{errRecordConflict, errHostedZoneNotFound, errAccessDenied} {
+				if errors.Is(got, kind) != (kind == tt.want) {
+					t.Errorf("errors.Is(classifyAPIError(), %v) = %v", kind, !(kind == tt.want))
+				}
+			}
+			if !errors.Is(got, tt.err) {
+				t.Errorf("classifyAPIError() = %v, want it to wrap %v", got, tt.err)
+			}
+		})
+	}
+	if classifyAPIError(nil) != nil {
+		t.Error("classifyAPIError(nil) != nil")
+	}
+}
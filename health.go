@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// registered is true while the DNS record is set up and in sync
+var registered atomic.Bool
+
+// livenessHandler serves /healthz, ok as long as the sidecar runs, so a task that is still registering is not killed
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyHandler serves /ready, ok only while the DNS record is registered and in sync
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !registered.Load() {
+		http.Error(w, "not registered", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// startServers starts the health and metrics servers, sharing one listener when the ports are equal
+func startServers() []*http.Server {
+	muxes := map[int]*http.ServeMux{}
+	mux := func(port int) *http.ServeMux {
+		if muxes[port] == nil {
+			muxes[port] = http.NewServeMux()
+		}
+		return muxes[port]
+	}
+	if healthPort > 0 {
+		mux(healthPort).HandleFunc("/healthz", livenessHandler)
+		mux(healthPort).HandleFunc("/ready", readyHandler)
+	}
+	if metricsPort > 0 {
+		mux(metricsPort).Handle("/metrics", metricsHandler)
+	}
+
+	var servers []*http.Server
+	for port, handler := range muxes {
+		servers = append(servers, startServer(port, handler))
+	}
+	return servers
+}
+
+func startServer(port int, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		log.Infof("HTTP server listening on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+	return server
+}
+
+func stopServers(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Failed to shut down HTTP server on %s: %v", server.Addr, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_healthHandlers(t *testing.T) {
+	registered.Store(false)
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+	live := func() int {
+		rec := httptest.NewRecorder()
+		livenessHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("before Register: /ready status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := live(); code != http.StatusOK {
+		t.Errorf("before Register: /healthz status = %d, want %d", code, http.StatusOK)
+	}
+
+	r := testRegistrar(&mockRoute53{})
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("after Register: /ready status = %d, want %d", code, http.StatusOK)
+	}
+
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("after Unregister: /ready status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := live(); code != http.StatusOK {
+		t.Errorf("after Unregister: /healthz status = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// IPSource resolves the IP address to register, the -ipaddress value selects the implementation
+type IPSource interface {
+	Resolve(ctx context.Context) (string, error)
+	String() string // the -ipaddress value
+}
+
+// stdin is where -ipaddress stdin reads the address from
+var stdin io.Reader = os.Stdin
+
+// newIPSource returns the source of an -ipaddress value: EC2 or ECS metadata, a file, stdin or the address itself
+func newIPSource(cfg aws.Config, value string) (IPSource, error) {
+	if path, ok := strings.CutPrefix(value, "file:"); ok {
+		return fileSource(path), nil
+	}
+	if value == "stdin" {
+		return stdinSource{stdin}, nil
+	}
+	if path, ok := imdsPath(value); ok {
+		return imdsSource{client: newImdsClient(cfg), name: value, path: path}, nil
+	}
+	if value != "ecs" {
+		return literalSource(value), nil
+	}
+
+	var cidr *net.IPNet
+	if ipCIDR != "" {
+		var err error
+		if _, cidr, err = net.ParseCIDR(ipCIDR); err != nil {
+			return nil, fmt.Errorf("invalid -ipcidr: %w", err)
+		}
+	}
+	// -recordtype picks the address family, auto and PTR default to IPv4
+	return ecsSource{ipv6: recordType == string(types.RRTypeAaaa), cidr: cidr}, nil
+}
+
+// refreshable reports whether the address of src may change while running, so it is worth resolving again
+func refreshable(src IPSource) bool {
+	switch src.(type) {
+	case literalSource, stdinSource: // stdin is only read once
+		return false
+	}
+	return true
+}
+
+// ipv6Source returns the IPv6 counterpart of a metadata source for -dualstack
+func ipv6Source(src IPSource) (IPSource, error) {
+	switch s := src.(type) {
+	case ecsSource:
+		return ecsSource{ipv6: true}, nil // -ipcidr selects the IPv4 address
+	case imdsSource:
+		return imdsSource{client: s.client, name: "ipv6", path: "ipv6"}, nil // the primary IPv6 address of the instance
+	}
+	return nil, fmt.Errorf("-ipaddress %s has no IPv6 counterpart, use ecs or an EC2 instance metadata address", src)
+}
+
+// resolveDualStack resolves the IPv4 address of v4 and the IPv6 address of v6. When only one of them is available
+// it warns and returns that source and its address alone, so the sidecar registers the one record it can.
+func resolveDualStack(ctx context.Context, v4, v6 IPSource) (src IPSource, address, ipv6 string, err error) {
+	address, err4 := v4.Resolve(ctx)
+	ipv6, err6 := v6.Resolve(ctx)
+	switch {
+	case err4 != nil && err6 != nil:
+		return nil, "", "", fmt.Errorf("neither an IPv4 nor an IPv6 address for -dualstack: %w", errors.Join(err4, err6))
+	case err4 != nil:
+		log.Warnf("No IPv4 address for -dualstack, only registering the AAAA record: %v", err4)
+		return v6, ipv6, "", nil
+	case err6 != nil:
+		log.Warnf("No IPv6 address for -dualstack, only registering the A record: %v", err6)
+		return v4, address, "", nil
+	}
+	return v4, address, ipv6, nil
+}
+
+// literalSource is an -ipaddress given as the address itself, it is validated with the record type
+type literalSource string
+
+func (s literalSource) Resolve(context.Context) (string, error) { return string(s), nil }
+func (s literalSource) String() string                          { return string(s) }
+
+// fileSource reads the address from the first line of a file, e.g. written by an init container
+type fileSource string
+
+func (s fileSource) Resolve(context.Context) (string, error) {
+	log.Infof("Reading IP Address from %s", string(s))
+	f, err := os.Open(string(s))
+	if err != nil {
+		return "", fmt.Errorf("unable to read the IP address: %w", err)
+	}
+	defer f.Close()
+	return readAddress(f, string(s))
+}
+
+func (s fileSource) String() string { return "file:" + string(s) }
+
+// stdinSource reads the address from the first line of r
+type stdinSource struct{ r io.Reader }
+
+func (s stdinSource) Resolve(context.Context) (string, error) {
+	log.Info("Reading IP Address from stdin")
+	return readAddress(s.r, "stdin")
+}
+
+func (s stdinSource) String() string { return "stdin" }
+
+// imdsSource fetches the address from an EC2 instance metadata path
+type imdsSource struct {
+	client imdsAPI
+	name   string // the -ipaddress value, e.g. public-ipv4
+	path   string
+}
+
+func (s imdsSource) Resolve(ctx context.Context) (string, error) {
+	log.Infof("Fetching IP Address from EC2 %s", s.name)
+	address, err := getImdsAddress(ctx, s.client, s.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve the IP address from the EC2 metadata: %w", err)
+	}
+	return address, nil
+}
+
+func (s imdsSource) String() string { return s.name }
+
+// ecsSource fetches the address of the task from the ECS task metadata
+type ecsSource struct {
+	ipv6 bool
+	cidr *net.IPNet // prefer the address in this subnet, nil for the first one
+}
+
+func (s ecsSource) Resolve(ctx context.Context) (string, error) {
+	log.Info("Fetching IP Address from ECS metadata")
+	address, err := getEcsAddress(ctx, s.ipv6, s.cidr)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch IP Address from ECS metadata: %w", err)
+	}
+	return address, nil
+}
+
+func (s ecsSource) String() string { return "ecs" }
+
+// readAddress reads the IP address on the first line of r, name is used in errors
+func readAddress(r io.Reader, name string) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("unable to read the IP address from %s: %w", name, err)
+	}
+	address := strings.TrimSpace(line)
+	if address == "" {
+		return "", fmt.Errorf("no IP address in %s", name)
+	}
+	if net.ParseIP(address) == nil {
+		return "", fmt.Errorf("%s contains %q, not an IP address", name, address)
+	}
+	return address, nil
+}
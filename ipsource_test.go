@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func Test_newIPSource(t *testing.T) {
+	defer func(cidr string) { ipCIDR = cidr }(ipCIDR)
+	ipCIDR = ""
+
+	tests := []struct {
+		value       string
+		want        IPSource
+		refreshable bool
+	}{
+		{"10.0.0.1", literalSource("10.0.0.1"), false},
+		{"file:/run/ip", fileSource("/run/ip"), true},
+		{"stdin", stdinSource{stdin}, false},
+		{"ecs", ecsSource{}, true},
+	}
+	for _, tt := range tests {
+		got, err := newIPSource(aws.Config{}, tt.value)
+		if err != nil {
+			t.Fatalf("newIPSource(%q) error = %v", tt.value, err)
+		}
+		if got != tt.want {
+			t.Errorf("newIPSource(%q) = %#v, want %#v", tt.value, got, tt.want)
+		}
+		if got.String() != tt.value {
+			t.Errorf("newIPSource(%q).String() = %q", tt.value, got.String())
+		}
+		if refreshable(got) != tt.refreshable {
+			t.Errorf("refreshable(%q) = %v, want %v", tt.value, refreshable(got), tt.refreshable)
+		}
+	}
+
+	for _, value := range []string{"public-ipv4", "imds:/ipv6"} {
+		got, err := newIPSource(aws.Config{}, value)
+		if _, ok := got.(imdsSource); err != nil || !ok || got.String() != value {
+			t.Errorf("newIPSource(%q) = %#v, %v, want an imdsSource", value, got, err)
+		}
+	}
+
+	ipCIDR = "10.0.2.0/24"
+	got, err := newIPSource(aws.Config{}, "ecs")
+	if source, ok := got.(ecsSource); err != nil || !ok || source.cidr.String() != ipCIDR {
+		t.Errorf("newIPSource(ecs) with -ipcidr = %#v, %v", got, err)
+	}
+	ipCIDR = "10.0.2.0"
+	if _, err := newIPSource(aws.Config{}, "ecs"); err == nil {
+		t.Error("newIPSource(ecs) with an invalid -ipcidr error = nil, want error")
+	}
+}
+
+func Test_literalSource(t *testing.T) {
+	if got, err := literalSource("2001:db8::1").Resolve(context.Background()); err != nil || got != "2001:db8::1" {
+		t.Errorf("Resolve() = %q, %v, want 2001:db8::1", got, err)
+	}
+}
+
+func Test_fileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip")
+	if err := os.WriteFile(path, []byte(" 10.0.0.7 \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fileSource(path).Resolve(context.Background()); err != nil || got != "10.0.0.7" {
+		t.Errorf("Resolve() = %q, %v, want 10.0.0.7", got, err)
+	}
+
+	if _, err := fileSource(filepath.Join(t.TempDir(), "missing")).Resolve(context.Background()); err == nil {
+		t.Error("Resolve() of a missing file error = nil, want error")
+	}
+
+	if err := os.WriteFile(path, []byte("not-an-ip\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileSource(path).Resolve(context.Background()); err == nil {
+		t.Error("Resolve() of a file without an IP error = nil, want error")
+	}
+}
+
+func Test_stdinSource(t *testing.T) {
+	var r io.Reader = strings.NewReader("2001:db8::1\nignored\n")
+	if got, err := (stdinSource{r}).Resolve(context.Background()); err != nil || got != "2001:db8::1" {
+		t.Errorf("Resolve() = %q, %v, want 2001:db8::1", got, err)
+	}
+}
+
+func Test_imdsSource(t *testing.T) {
+	client := &mockImds{values: map[string]string{"public-ipv4": "203.0.113.7", "local-hostname": "ip-10-0-0-1"}}
+	source := imdsSource{client: client, name: "public-ipv4", path: "public-ipv4"}
+	if got, err := source.Resolve(context.Background()); err != nil || got != "203.0.113.7" {
+		t.Errorf("Resolve() = %q, %v, want 203.0.113.7", got, err)
+	}
+
+	source = imdsSource{client: client, name: "imds:local-hostname", path: "local-hostname"}
+	if _, err := source.Resolve(context.Background()); err == nil {
+		t.Error("Resolve() of a value that is not an IP error = nil, want error")
+	}
+}
+
+func Test_ecsSource(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := fmt.Sprintf("10.0.2.%d", calls.Add(1))
+		w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["` + ip + `"]}]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+	for _, want := range []string{"10.0.2.1", "10.0.2.2"} { // resolved again on every call
+		if got, err := (ecsSource{}).Resolve(context.Background()); err != nil || got != want {
+			t.Errorf("Resolve() = %v, %v, want %v", got, err, want)
+		}
+	}
+}
+
+func Test_resolveDualStack(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v4only/task" {
+			w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["10.0.2.106"]}]}]}`))
+			return
+		}
+		w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["10.0.2.106"],"IPv6Addresses":["2001:db8::106"]}]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	v6, err := ipv6Source(ecsSource{})
+	if err != nil {
+		t.Fatalf("ipv6Source(ecs) error = %v", err)
+	}
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+	if _, address, ipv6, err := resolveDualStack(context.Background(), ecsSource{}, v6); err != nil || address != "10.0.2.106" || ipv6 != "2001:db8::106" {
+		t.Errorf("resolveDualStack() = %v, %v, %v, want both addresses", address, ipv6, err)
+	}
+
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL+"/v4only")
+	if _, address, ipv6, err := resolveDualStack(context.Background(), ecsSource{}, v6); err != nil || address != "10.0.2.106" || ipv6 != "" {
+		t.Errorf("resolveDualStack() = %v, %v, %v, want only the IPv4 address", address, ipv6, err)
+	}
+
+	if _, err := ipv6Source(literalSource("10.0.0.1")); err == nil {
+		t.Error("ipv6Source(10.0.0.1) error = nil, want no IPv6 counterpart")
+	}
+}
+
+func Test_ecsSourceFamily(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v4only/task" {
+			w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["10.0.2.106"]}]}]}`))
+			return
+		}
+		w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["10.0.2.106"],"IPv6Addresses":["2001:db8::106"]}]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+	defer func(rt string) { recordType = rt }(recordType)
+	for rt, want := range map[string]string{"A": "10.0.2.106", "AUTO": "10.0.2.106", "AAAA": "2001:db8::106"} {
+		recordType = rt
+		source, err := newIPSource(aws.Config{}, "ecs")
+		if err != nil {
+			t.Fatalf("newIPSource(ecs) error = %v", err)
+		}
+		if got, err := source.Resolve(context.Background()); err != nil || got != want {
+			t.Errorf("Resolve() with -recordtype %s = %v, %v, want %v", rt, got, err, want)
+		}
+	}
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL+"/v4only")
+	if _, err := (ecsSource{ipv6: true}).Resolve(context.Background()); err == nil || !strings.Contains(err.Error(), "no IPv6 address") {
+		t.Errorf("Resolve() error = %v, want no IPv6 address", err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.0.3.0/24")
+	if _, err := (ecsSource{cidr: subnet}).Resolve(context.Background()); err == nil {
+		t.Error("Resolve() with a -ipcidr of no address error = nil, want error")
+	}
+}
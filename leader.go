@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// Locker gates the registration on a leader election, only the task holding the lock owns the records
+type Locker interface {
+	// Acquire takes or renews the lock and reports whether this task holds it
+	Acquire(ctx context.Context) (bool, error)
+	// Release gives up the lock when this task holds it
+	Release(ctx context.Context) error
+}
+
+// errNotLeader is returned by Register when another task holds the leader lock
+var errNotLeader = errors.New("another task holds the leader lock")
+
+// newLeaderLocker returns the Locker of a -leaderlock value, replaced by a fake in tests
+var newLeaderLocker = newLocker
+
+// newLocker returns the DynamoDB Locker of a -leaderlock dynamodb:<table>, -leaderlock txt is built by newHeartbeatLocker
+func newLocker(cfg aws.Config, value, key, owner string, lease time.Duration) (Locker, error) {
+	table, ok := strings.CutPrefix(value, "dynamodb:")
+	if !ok || table == "" {
+		return nil, fmt.Errorf("invalid -leaderlock %q: want dynamodb:<table> or %s", value, leaderLockTXT)
+	}
+	return &dynamoLocker{api: newDynamoDBClient(cfg), table: table, key: key, owner: owner, lease: lease}, nil
+}
+
+// sharedLocker is the leader lock of several hosted zones, each zone holding it through its own forZone Locker.
+// The lock is released once every zone that acquired it has released it, so the lock is never given up while
+// the records of another zone are still being torn down.
+type sharedLocker struct {
+	mu      sync.Mutex // serializes the calls to the lock with the changes of holders
+	locker  Locker
+	holders map[*zoneLocker]bool
+}
+
+func newSharedLocker(locker Locker) *sharedLocker {
+	return &sharedLocker{locker: locker, holders: map[*zoneLocker]bool{}}
+}
+
+// forZone returns the Locker of one hosted zone
+func (s *sharedLocker) forZone() Locker {
+	return &zoneLocker{shared: s}
+}
+
+// zoneLocker is the hold of one hosted zone on a sharedLocker
+type zoneLocker struct {
+	shared *sharedLocker
+}
+
+// Acquire takes or renews the shared lock, the zone holds it as long as it is granted
+func (z *zoneLocker) Acquire(ctx context.Context) (bool, error) {
+	s := z.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	leader, err := s.locker.Acquire(ctx)
+	if err == nil && !leader {
+		delete(s.holders, z)
+	} else if leader {
+		s.holders[z] = true
+	}
+	return leader, err
+}
+
+// Release gives up the hold of the zone, and the shared lock with the last hold
+func (z *zoneLocker) Release(ctx context.Context) error {
+	s := z.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.holders, z)
+	if len(s.holders) > 0 {
+		return nil
+	}
+	return s.locker.Release(ctx)
+}
+
+// leaderLockTXT is the -leaderlock kept as a heartbeat TXT record in the hosted zone itself
+const leaderLockTXT = "txt"
+
+// heartbeatName is the default name of the heartbeat TXT record of a -leaderlock txt
+func heartbeatName(name string) string {
+	return "_heartbeat." + strings.TrimPrefix(name, "*.")
+}
+
+// newHeartbeatLocker returns the Locker of -leaderlock txt, a heartbeat record name in zone that is stale after lease
+func newHeartbeatLocker(r53 route53API, zone, name, owner string, lease time.Duration) (Locker, error) {
+	if lease <= 0 {
+		return nil, fmt.Errorf("-leaderlock %s needs a -leaderlease, after which a heartbeat is stale and the records may be claimed", leaderLockTXT)
+	}
+	if err := validateDomainName(name); err != nil {
+		return nil, fmt.Errorf("invalid -leaderkey %q for -leaderlock %s: %w", name, leaderLockTXT, err)
+	}
+	return &heartbeatLocker{api: r53, zone: zone, name: name, owner: owner, lease: lease}, nil
+}
+
+// heartbeatLocker holds the leader lock as a TXT record "owner=<owner> heartbeat=<unix time>", claimed once the
+// heartbeat of another owner is older than the lease. The old value is deleted in the same batch as the new one
+// is created, so Route53 rejects the claim of a task that lost the race to another.
+type heartbeatLocker struct {
+	api   route53API
+	zone  string
+	name  string
+	owner string
+	lease time.Duration
+}
+
+// Acquire writes a fresh heartbeat unless another owner wrote one within the lease
+func (l *heartbeatLocker) Acquire(ctx context.Context) (bool, error) {
+	current, err := l.current(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if current != nil {
+		owner, at := parseHeartbeat(current)
+		if owner != l.owner && now.Sub(at) < l.lease {
+			log.Debugf("Heartbeat %s of %s is %v old, not claiming the records", l.name, owner, now.Sub(at).Round(time.Second))
+			return false, nil
+		} else if owner != l.owner {
+			log.Infof("Heartbeat %s of %s is stale (%v old), claiming the records", l.name, owner, now.Sub(at).Round(time.Second))
+		}
+	}
+
+	value := quoteTXT(fmt.Sprintf("owner=%s heartbeat=%d", l.owner, now.Unix()))
+	changes := []types.Change{{Action: types.ChangeActionCreate, ResourceRecordSet: &types.ResourceRecordSet{
+		Name:            aws.String(l.name),
+		Type:            types.RRTypeTxt,
+		TTL:             aws.Int64(int64(max(l.lease/time.Second, 1))),
+		ResourceRecords: []types.ResourceRecord{{Value: aws.String(value)}},
+	}}}
+	if current != nil {
+		changes = append([]types.Change{{Action: types.ChangeActionDelete, ResourceRecordSet: current}}, changes...)
+	}
+	if err := l.change(ctx, changes); isInvalidBatchError(err) {
+		log.Debugf("Another task wrote heartbeat %s first: %v", l.name, err)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Release deletes the heartbeat when it is ours, so another task may claim the records right away
+func (l *heartbeatLocker) Release(ctx context.Context) error {
+	current, err := l.current(ctx)
+	if err != nil || current == nil {
+		return err
+	}
+	if owner, _ := parseHeartbeat(current); owner != l.owner {
+		return nil
+	}
+	if err := l.change(ctx, []types.Change{{Action: types.ChangeActionDelete, ResourceRecordSet: current}}); err != nil && !isInvalidBatchError(err) {
+		return err
+	}
+	return nil
+}
+
+// current returns the heartbeat record, nil when there is none
+func (l *heartbeatLocker) current(ctx context.Context) (*types.ResourceRecordSet, error) {
+	var output *route53.ListResourceRecordSetsOutput
+	err := retryWithBackoff(ctx, maxRetries, retryBaseDelay, isTransientError, func() error {
+		return callWithTimeout(ctx, apiTimeout, func(ctx context.Context) (err error) {
+			output, err = l.api.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+				HostedZoneId:    aws.String(l.zone),
+				StartRecordName: aws.String(l.name),
+				StartRecordType: types.RRTypeTxt,
+				MaxItems:        aws.Int32(1),
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read heartbeat %s: %w", l.name, classifyAPIError(err))
+	}
+	for _, rrs := range output.ResourceRecordSets {
+		if sameDomainName(aws.ToString(rrs.Name), l.name) && rrs.Type == types.RRTypeTxt {
+			return &rrs, nil
+		}
+	}
+	return nil, nil
+}
+
+func (l *heartbeatLocker) change(ctx context.Context, changes []types.Change) error {
+	return retryWithBackoff(ctx, maxRetries, retryBaseDelay, isTransientError, func() error {
+		return callWithTimeout(ctx, apiTimeout, func(ctx context.Context) error {
+			_, err := l.api.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+				HostedZoneId: aws.String(l.zone),
+				ChangeBatch:  &types.ChangeBatch{Changes: changes, Comment: aws.String("route53-sidecar heartbeat")},
+			})
+			return err
+		})
+	})
+}
+
+// parseHeartbeat returns the owner and time of a heartbeat record, a record it cannot parse is stale
+func parseHeartbeat(rrs *types.ResourceRecordSet) (owner string, at time.Time) {
+	if len(rrs.ResourceRecords) == 0 {
+		return "", time.Time{}
+	}
+	for _, field := range strings.Fields(strings.Trim(aws.ToString(rrs.ResourceRecords[0].Value), `"`)) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "owner":
+			owner = value
+		case "heartbeat":
+			if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+				at = time.Unix(unix, 0)
+			}
+		}
+	}
+	return owner, at
+}
+
+// lockOwner identifies this task in the leader lock, the ECS task ARN or the host name
+func lockOwner(taskARN string) string {
+	if taskARN != "" {
+		return taskARN
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// dynamoDBAPI is the part of the DynamoDB client the leader lock uses, mocked in tests
+type dynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// newDynamoDBClient creates the DynamoDB client of the leader lock from the task's config, replaced by a mock in tests.
+// It resolves the endpoint of the region's partition, -endpoint only applies to Route53.
+var newDynamoDBClient = func(cfg aws.Config) dynamoDBAPI {
+	return dynamodb.NewFromConfig(cfg)
+}
+
+// dynamoLocker holds the leader lock as an item of a DynamoDB table with the partition key LockID,
+// written with conditional puts so only one owner gets it. The item expires after the lease unless renewed.
+type dynamoLocker struct {
+	api   dynamoDBAPI
+	table string
+	key   string // the LockID of the item
+	owner string
+	lease time.Duration // 0 holds the lock until it is released
+}
+
+// Acquire puts our item unless another owner holds an unexpired one
+func (l *dynamoLocker) Acquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	expires := int64(0)
+	if l.lease > 0 {
+		expires = now.Add(l.lease).Unix()
+	}
+	err := l.call(ctx, func(ctx context.Context) error {
+		_, err := l.api.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(l.table),
+			Item: map[string]dbtypes.AttributeValue{
+				"LockID":  &dbtypes.AttributeValueMemberS{Value: l.key},
+				"Owner":   &dbtypes.AttributeValueMemberS{Value: l.owner},
+				"Expires": &dbtypes.AttributeValueMemberN{Value: strconv.FormatInt(expires, 10)},
+			},
+			ConditionExpression:      aws.String("attribute_not_exists(LockID) OR #owner = :owner OR (#expires > :zero AND #expires < :now)"),
+			ExpressionAttributeNames: map[string]string{"#owner": "Owner", "#expires": "Expires"},
+			ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+				":owner": &dbtypes.AttributeValueMemberS{Value: l.owner},
+				":zero":  &dbtypes.AttributeValueMemberN{Value: "0"},
+				":now":   &dbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			},
+		})
+		return err
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to acquire the leader lock %s in table %s: %w", l.key, l.table, err)
+	}
+	return true, nil
+}
+
+// Release deletes our item, an item of another owner is left alone
+func (l *dynamoLocker) Release(ctx context.Context) error {
+	err := l.call(ctx, func(ctx context.Context) error {
+		_, err := l.api.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(l.table),
+			Key:                       map[string]dbtypes.AttributeValue{"LockID": &dbtypes.AttributeValueMemberS{Value: l.key}},
+			ConditionExpression:       aws.String("#owner = :owner"),
+			ExpressionAttributeNames:  map[string]string{"#owner": "Owner"},
+			ExpressionAttributeValues: map[string]dbtypes.AttributeValue{":owner": &dbtypes.AttributeValueMemberS{Value: l.owner}},
+		})
+		return err
+	})
+	if err != nil && !isConditionFailed(err) {
+		return fmt.Errorf("unable to release the leader lock %s in table %s: %w", l.key, l.table, err)
+	}
+	return nil
+}
+
+// call retries fn on transient errors with exponential backoff, each attempt bounded by -apitimeout
+func (l *dynamoLocker) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	return retryWithBackoff(ctx, maxRetries, retryBaseDelay, isTransientError, func() error {
+		return callWithTimeout(ctx, apiTimeout, fn)
+	})
+}
+
+// isConditionFailed reports whether the conditional write failed, i.e. the lock belongs to another owner
+func isConditionFailed(err error) bool {
+	var conditionFailed *dbtypes.ConditionalCheckFailedException
+	return errors.As(err, &conditionFailed)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeLocker grants the lock when grant is set and counts the calls
+type fakeLocker struct {
+	grant    bool
+	acquires int
+	releases int
+}
+
+func (l *fakeLocker) Acquire(context.Context) (bool, error) {
+	l.acquires++
+	return l.grant, nil
+}
+
+func (l *fakeLocker) Release(context.Context) error {
+	l.releases++
+	return nil
+}
+
+func Test_RegisterLeaderLock(t *testing.T) {
+	tests := []struct {
+		name        string
+		grant       bool
+		wantErr     error
+		wantChanges int
+		releases    int
+	}{
+		{"granted", true, nil, 2, 1},
+		{"denied", false, errNotLeader, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockRoute53{}
+			locker := &fakeLocker{grant: tt.grant}
+			r := testRegistrar(mock)
+			r.Locker = locker
+			r.SkipTTLWait = true
+
+			if err := r.Register(context.Background()); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Register() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := r.Unregister(context.Background()); err != nil {
+				t.Errorf("Unregister() error = %v", err)
+			}
+			if len(mock.inputs) != tt.wantChanges {
+				t.Errorf("ChangeResourceRecordSets called %d times, want %d", len(mock.inputs), tt.wantChanges)
+			}
+			if locker.releases != tt.releases {
+				t.Errorf("Release called %d times, want %d", locker.releases, tt.releases)
+			}
+		})
+	}
+}
+
+func Test_runLeaderLockDenied(t *testing.T) {
+	defer func(f func(aws.Config, string, string, string, time.Duration) (Locker, error)) { newLeaderLocker = f }(newLeaderLocker)
+	mock := &mockRoute53{}
+	locker := &fakeLocker{}
+	newLeaderLocker = func(cfg aws.Config, value, key, owner string, lease time.Duration) (Locker, error) {
+		if value != "dynamodb:locks" || key != "my.example.com" {
+			t.Errorf("newLeaderLocker(%q, %q), want the table and the -dns name", value, key)
+		}
+		return locker, nil
+	}
+	args := []string{"-register", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-syncpollinterval=1ms", "-leaderlock=dynamodb:locks"}
+
+	if err := runWithMock(t, mock, args...); err != nil {
+		t.Errorf("run() error = %v, want a passive task to exit cleanly", err)
+	}
+	if locker.acquires != 1 || len(mock.inputs) != 0 {
+		t.Errorf("got %d lock attempts and %d changes, want 1 and none", locker.acquires, len(mock.inputs))
+	}
+}
+
+func Test_sharedLocker(t *testing.T) {
+	locker := &fakeLocker{grant: true}
+	shared := newSharedLocker(locker)
+	var rs registrars
+	for _, zone := range []string{"ZPUBLIC", "ZPRIVATE"} {
+		r := testRegistrar(&mockRoute53{})
+		r.HostedZone = zone
+		r.SkipTTLWait = true
+		r.Locker = shared.forZone()
+		rs = append(rs, r)
+	}
+	ctx := context.Background()
+	if err := rs.Register(ctx); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	// The lock is still held for the zone that is yet to be torn down
+	if err := rs[0].Unregister(ctx); err != nil {
+		t.Fatalf("Unregister(ZPUBLIC) error = %v", err)
+	}
+	if locker.releases != 0 {
+		t.Errorf("Release called %d times before the last zone was torn down, want 0", locker.releases)
+	}
+	if err := rs[1].Unregister(ctx); err != nil {
+		t.Fatalf("Unregister(ZPRIVATE) error = %v", err)
+	}
+	if locker.releases != 1 {
+		t.Errorf("Release called %d times, want 1 once every zone was torn down", locker.releases)
+	}
+}
+
+// mockDynamoDB keeps the lock items by LockID and evaluates the conditions of dynamoLocker on the owner only
+type mockDynamoDB struct {
+	items   map[string]string // LockID to Owner
+	wantErr error             // returned once by the next call
+	calls   int
+}
+
+func (m *mockDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.calls++
+	if err := m.wantErr; err != nil {
+		m.wantErr = nil
+		return nil, err
+	}
+	key := params.Item["LockID"].(*dbtypes.AttributeValueMemberS).Value
+	owner := params.Item["Owner"].(*dbtypes.AttributeValueMemberS).Value
+	if held, ok := m.items[key]; ok && held != owner {
+		return nil, &dbtypes.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	m.items[key] = owner
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *mockDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	m.calls++
+	key := params.Key["LockID"].(*dbtypes.AttributeValueMemberS).Value
+	if m.items[key] != params.ExpressionAttributeValues[":owner"].(*dbtypes.AttributeValueMemberS).Value {
+		return nil, &dbtypes.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	delete(m.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func Test_dynamoLocker(t *testing.T) {
+	defer func(retries int, delay time.Duration) { maxRetries, retryBaseDelay = retries, delay }(maxRetries, retryBaseDelay)
+	maxRetries, retryBaseDelay = 3, time.Millisecond
+	mock := &mockDynamoDB{items: map[string]string{}}
+	defer func(f func(aws.Config) dynamoDBAPI) { newDynamoDBClient = f }(newDynamoDBClient)
+	newDynamoDBClient = func(aws.Config) dynamoDBAPI { return mock }
+
+	locker, err := newLocker(aws.Config{}, "dynamodb:locks", "api.example.com", "task-1", time.Minute)
+	if err != nil {
+		t.Fatalf("newLocker() error = %v", err)
+	}
+	other, _ := newLocker(aws.Config{}, "dynamodb:locks", "api.example.com", "task-2", time.Minute)
+	ctx := context.Background()
+
+	// A throttled call is retried
+	mock.wantErr = &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"}
+	if leader, err := locker.Acquire(ctx); err != nil || !leader {
+		t.Errorf("Acquire() = %v, %v, want the free lock", leader, err)
+	}
+	if mock.calls != 2 {
+		t.Errorf("got %d calls, want the throttled PutItem retried", mock.calls)
+	}
+	if leader, err := other.Acquire(ctx); err != nil || leader {
+		t.Errorf("Acquire() = %v, %v, want the lock denied once held", leader, err)
+	}
+	if err := other.Release(ctx); err != nil {
+		t.Errorf("Release() of another owner error = %v", err)
+	}
+	if err := locker.Release(ctx); err != nil {
+		t.Errorf("Release() error = %v", err)
+	}
+	if leader, err := other.Acquire(ctx); err != nil || !leader {
+		t.Errorf("Acquire() = %v, %v, want the released lock", leader, err)
+	}
+
+	mock.wantErr = errors.New("AccessDeniedException")
+	if leader, err := locker.Acquire(ctx); err == nil || leader {
+		t.Errorf("Acquire() = %v, %v, want the error", leader, err)
+	}
+
+	if _, err := newLocker(aws.Config{}, "s3:bucket", "key", "task-1", 0); err == nil {
+		t.Error("newLocker(s3:bucket) error = nil, want unsupported")
+	}
+}
+
+func Test_heartbeatLocker(t *testing.T) {
+	heartbeat := func(owner string, age time.Duration) types.ResourceRecordSet {
+		return types.ResourceRecordSet{
+			Name:            aws.String("_heartbeat.api.example.com"),
+			Type:            types.RRTypeTxt,
+			TTL:             aws.Int64(60),
+			ResourceRecords: []types.ResourceRecord{{Value: aws.String(quoteTXT(fmt.Sprintf("owner=%s heartbeat=%d", owner, time.Now().Add(-age).Unix())))}},
+		}
+	}
+	tests := []struct {
+		name     string
+		existing []types.ResourceRecordSet
+		want     bool
+	}{
+		{"none", nil, true},
+		{"fresh", []types.ResourceRecordSet{heartbeat("task-2", 10*time.Second)}, false},
+		{"stale", []types.ResourceRecordSet{heartbeat("task-2", 2*time.Minute)}, true},
+		{"own", []types.ResourceRecordSet{heartbeat("task-1", 10*time.Second)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+			for _, rrs := range tt.existing {
+				mock.records[recordKey(&rrs)] = rrs
+			}
+			locker, err := newHeartbeatLocker(mock, "Z123", "_heartbeat.api.example.com", "task-1", time.Minute)
+			if err != nil {
+				t.Fatalf("newHeartbeatLocker() error = %v", err)
+			}
+			leader, err := locker.Acquire(context.Background())
+			if err != nil || leader != tt.want {
+				t.Fatalf("Acquire() = %v, %v, want %v", leader, err, tt.want)
+			}
+
+			rrs := mock.records["_heartbeat.api.example.com/TXT/"]
+			owner, at := parseHeartbeat(&rrs)
+			if tt.want && (owner != "task-1" || time.Since(at) > time.Minute) {
+				t.Errorf("heartbeat = %s at %v, want a fresh one of task-1", owner, at)
+			} else if !tt.want && len(mock.inputs) != 0 {
+				t.Errorf("ChangeResourceRecordSets called %d times, want the fresh heartbeat of another task left alone", len(mock.inputs))
+			}
+			if tt.existing != nil && tt.want {
+				if changes := mock.inputs[0].ChangeBatch.Changes; len(changes) != 2 || changes[0].Action != types.ChangeActionDelete {
+					t.Errorf("changes = %v, want the old heartbeat deleted in the same batch", changes)
+				}
+			}
+
+			if err := locker.Release(context.Background()); err != nil {
+				t.Errorf("Release() error = %v", err)
+			}
+			if _, ok := mock.records["_heartbeat.api.example.com/TXT/"]; ok == tt.want {
+				t.Errorf("heartbeat left after Release() = %v, want %v", ok, !tt.want)
+			}
+		})
+	}
+
+	// Another task claimed the stale heartbeat between our read and our write
+	stale := heartbeat("task-2", 2*time.Minute)
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{recordKey(&stale): stale}, wantErrs: []error{&types.InvalidChangeBatch{Message: aws.String("Tried to delete resource record set but it was not found")}}}
+	locker, _ := newHeartbeatLocker(mock, "Z123", "_heartbeat.api.example.com", "task-1", time.Minute)
+	if leader, err := locker.Acquire(context.Background()); err != nil || leader {
+		t.Errorf("Acquire() = %v, %v, want the lost race denied", leader, err)
+	}
+
+	if _, err := newHeartbeatLocker(mock, "Z123", "_heartbeat.api.example.com", "task-1", 0); err == nil {
+		t.Error("newHeartbeatLocker() without a lease error = nil, want an error")
+	}
+}
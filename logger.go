@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"strings"
+	"time"
+)
+
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l level) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARN"
+	case levelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+func parseLogLevel(s string) (level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info", "":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// logger is a small leveled wrapper around the standard library logger, writing text or JSON lines
+type logger struct {
+	out    *logOutput
+	fields []any // key value pairs added by With
+}
+
+// logOutput is shared by a logger and the loggers derived from it with With
+type logOutput struct {
+	std   *stdlog.Logger
+	level level
+	json  bool
+}
+
+func newLogger(w io.Writer, lvl level) *logger {
+	return &logger{out: &logOutput{std: stdlog.New(w, "", stdlog.LstdFlags), level: lvl}}
+}
+
+// log is the package-wide logger, it intentionally shadows the standard library package name
+var log = newLogger(os.Stderr, levelInfo)
+
+func (l *logger) SetLevel(lvl level) {
+	l.out.level = lvl
+}
+
+func (l *logger) SetOutput(w io.Writer) {
+	l.out.std.SetOutput(w)
+}
+
+// SetFormat switches between "text" and "json" output
+func (l *logger) SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "text", "":
+		l.out.json = false
+		l.out.std.SetFlags(stdlog.LstdFlags)
+	case "json":
+		l.out.json = true
+		l.out.std.SetFlags(0) // the time is a JSON field
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// With returns a logger which adds the given key value pairs to every line
+func (l *logger) With(kv ...any) *logger {
+	fields := make([]any, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{out: l.out, fields: fields}
+}
+
+func (l *logger) output(lvl level, msg string) {
+	if lvl < l.out.level {
+		return
+	}
+	l.write(lvl.String(), msg)
+}
+
+func (l *logger) write(lvl, msg string) {
+	if l.out.json {
+		l.out.std.Output(4, l.formatJSON(lvl, msg))
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(lvl + " " + msg)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", l.fields[i], l.fields[i+1])
+	}
+	l.out.std.Output(4, sb.String())
+}
+
+// formatJSON renders a line as a JSON object, keeping time, level and msg first
+func (l *logger) formatJSON(lvl, msg string) string {
+	var sb strings.Builder
+	field := func(key string, value any) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.Write(k)
+		sb.WriteByte(':')
+		sb.Write(v)
+	}
+	sb.WriteByte('{')
+	field("time", time.Now().UTC().Format(time.RFC3339Nano))
+	field("level", strings.ToLower(lvl))
+	field("msg", msg)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		field(fmt.Sprint(l.fields[i]), l.fields[i+1])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func (l *logger) Debugf(format string, v ...any) { l.output(levelDebug, fmt.Sprintf(format, v...)) }
+func (l *logger) Debug(v ...any)                 { l.output(levelDebug, fmt.Sprint(v...)) }
+func (l *logger) Infof(format string, v ...any)  { l.output(levelInfo, fmt.Sprintf(format, v...)) }
+func (l *logger) Info(v ...any)                  { l.output(levelInfo, fmt.Sprint(v...)) }
+func (l *logger) Warnf(format string, v ...any)  { l.output(levelWarn, fmt.Sprintf(format, v...)) }
+func (l *logger) Warn(v ...any)                  { l.output(levelWarn, fmt.Sprint(v...)) }
+func (l *logger) Errorf(format string, v ...any) { l.output(levelError, fmt.Sprintf(format, v...)) }
+func (l *logger) Error(v ...any)                 { l.output(levelError, fmt.Sprint(v...)) }
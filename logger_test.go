@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_loggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, levelInfo)
+
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Warn("warn")
+
+	got := buf.String()
+	if strings.Contains(got, "debug 1") {
+		t.Errorf("debug line emitted at info level: %q", got)
+	}
+	if !strings.Contains(got, "INFO info 2") {
+		t.Errorf("info line missing: %q", got)
+	}
+	if !strings.Contains(got, "WARN warn") {
+		t.Errorf("warn line missing: %q", got)
+	}
+
+	buf.Reset()
+	l.SetLevel(levelDebug)
+	l.Debug("now visible")
+	if !strings.Contains(buf.String(), "DEBUG now visible") {
+		t.Errorf("debug line missing at debug level: %q", buf.String())
+	}
+}
+
+func Test_parseLogLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    level
+		wantErr bool
+	}{
+		{"debug", levelDebug, false},
+		{"INFO", levelInfo, false},
+		{"warning", levelWarn, false},
+		{"error", levelError, false},
+		{"verbose", levelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLogLevel(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseLogLevel(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func Test_loggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, levelInfo)
+	if err := l.SetFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	l.With("dns", "my.example.com", "ttl", 10).Warnf("hello %s", "world")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("output %q is not JSON: %v", buf.String(), err)
+	}
+	want := map[string]any{"level": "warn", "msg": "hello world", "dns": "my.example.com", "ttl": float64(10)}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Errorf("time field missing: %q", buf.String())
+	}
+}
+
+func Test_RegisterSummaryLog(t *testing.T) {
+	r := testRegistrar(&mockRoute53{})
+	r.SyncPollInterval = 2 * time.Millisecond
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormat("json")
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormat("text")
+	}()
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var line struct {
+			Msg      string  `json:"msg"`
+			ChangeID string  `json:"changeId"`
+			Polls    float64 `json:"polls"`
+			Duration string  `json:"duration"`
+		}
+		if err := json.Unmarshal(raw, &line); err != nil {
+			t.Fatalf("line %q is not JSON: %v", raw, err)
+		}
+		if line.Msg != "Route53 Change Completed" {
+			continue
+		}
+		if line.ChangeID != "C123" || line.Polls != 1 {
+			t.Errorf("summary %q, want changeId C123 after 1 poll", raw)
+		}
+		if d, err := time.ParseDuration(line.Duration); err != nil || d <= 0 {
+			t.Errorf("summary duration = %q, want a positive duration", line.Duration)
+		}
+		return
+	}
+	t.Errorf("no summary line in %q", buf.String())
+}
+
+func Test_RegisterJSONLogs(t *testing.T) {
+	r := testRegistrar(&mockRoute53{})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormat("json")
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormat("text")
+	}()
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	found := false
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var line map[string]any
+		if err := json.Unmarshal(raw, &line); err != nil {
+			t.Fatalf("line %q is not JSON: %v", raw, err)
+		}
+		if line["dns"] != "my.example.com" || line["ip"] != r.IPAddress || line["zone"] != r.HostedZone {
+			t.Errorf("line %q is missing the record fields", raw)
+		}
+		if line["changeId"] == "C123" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no line with changeId in %q", buf.String())
+	}
+}
@@ -3,217 +3,1153 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"math"
+	"net"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/aws/aws-sdk-go-v2/service/route53/types"
 	"github.com/namsral/flag"
+	"golang.org/x/net/idna"
 )
 
 var (
 	version = "dev" // overridden by -ldflags
 
-	dns        string
-	hostedZone string
-	dnsTTL     int
-	ipAddress  string
+	configFile   string
+	dns          string
+	domainSuffix string
+	hostedZone   string
+	zoneName     string
+	privateZone  bool
+	vpcCheck     string
+	vpcID        string
+	assumeRole   string
+	externalID   string
+	region       string
+	profile      string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	endpoint     string
+	dnsTTL       int
+	minTTL       int
+	rejectLowTTL bool
+	ipAddress    string
+	ipCIDR       string
+	dualStack    bool
+	recordType   string
+	target       string
+	aliasTarget  string
+	aliasZone    string
+	txtValue     string
+	comment      string
+	webhook      string
+	stateFile    string
+	taskARN      string
+	logLevel     string
+	logFormat    string
+	healthPort   int
+	metricsPort  int
 
-	register, unRegister bool
+	srvPriority, srvWeight, srvPort int
 
-	r53 *route53.Client
+	register, unRegister, dryRun bool
+	output                       string
+	printVersion                 bool
+	quiet                        bool
+	once                         bool
+	failOnStopped, skipTTLWait   bool
+	waitRemainingTTL             bool
+	fastTeardown                 bool
+	noTeardown                   bool
+	waitSync                     bool
+	deleteStale                  bool
+	overwriteConflicting         bool
+	skipUnchanged                bool
+	splitInvalidBatch            bool
+	skipZoneCheck                bool
+	deleteFetched                bool
+	evaluateTargetHealth         bool
+
+	routingPolicy   string
+	setIdentifier   string
+	identifierCheck string
+	leaderLock      string
+	leaderKey       string
+	leaderLease     time.Duration
+	weight          int64
+	weightSource    string
+	geo             string
+	geoLocation     *types.GeoLocation
+
+	maxRetries      int
+	retryBaseDelay  time.Duration
+	refreshInterval time.Duration
+	ipRefresh       bool
+	setupDelay      time.Duration
+	startupJitter   time.Duration
+	waitPort        string
+	waitPortTimeout time.Duration
+	readyTimeout    time.Duration
+	readyAction     string
+	imdsTimeout     time.Duration
+	ecsTimeout      time.Duration
+	metadataRetries int
+	apiTimeout      time.Duration
+
+	syncPollInterval time.Duration
+	syncPollMax      time.Duration
+	syncTimeout      time.Duration
+	syncMaxFailures  int
+	stopPoll         time.Duration
+	container        string
 )
 
-func configureFromFlags(ctx context.Context) {
-	flag.StringVar(&dns, "dns", "my.example.com", "DNS name to register in Route53")
-	flag.StringVar(&hostedZone, "hostedzone", "Z2AAAABCDEFGT4", "Hosted zone ID in route53")
+// route53API is the subset of the Route53 client used by the sidecar
+type route53API interface {
+	ChangeResourceRecordSets(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error)
+	GetChange(ctx context.Context, params *route53.GetChangeInput, optFns ...func(*route53.Options)) (*route53.GetChangeOutput, error)
+	GetHostedZone(ctx context.Context, params *route53.GetHostedZoneInput, optFns ...func(*route53.Options)) (*route53.GetHostedZoneOutput, error)
+	ListHostedZonesByName(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error)
+	ListResourceRecordSets(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error)
+}
+
+func defineFlags() {
+	flag.StringVar(&configFile, "config", "", "YAML or JSON file with flag values, overridden by environment and flags")
+	flag.StringVar(&dns, "dns", "my.example.com", "DNS name(s) to register in Route53, comma separated; name=ttl overrides -dnsttl for that name")
+	flag.StringVar(&domainSuffix, "domainsuffix", "", "Domain appended to -dns names without any dot, e.g. example.com. turns api into api.example.com.")
+	flag.StringVar(&hostedZone, "hostedzone", "", "Hosted zone ID(s) in route53, comma separated to register in each, e.g. a public and a private zone")
+	flag.BoolVar(&skipZoneCheck, "skipzonecheck", false, "Do not check at startup that the -hostedzone exists, for roles without route53:GetHostedZone")
+	flag.StringVar(&zoneName, "hostedzonename", "", "Hosted zone name to look up when -hostedzone is not set")
+	flag.BoolVar(&privateZone, "private", false, "Prefer the private hosted zone when looking up -hostedzonename")
+	flag.StringVar(&vpcCheck, "vpccheck", checkOff, "Check private hosted zones are associated with the VPC of this task: off, warn or fail")
+	flag.StringVar(&vpcID, "vpcid", "", "VPC of this task for -vpccheck, fetched from EC2 instance metadata when not set")
+	flag.StringVar(&assumeRole, "assumerole", "", "ARN of an IAM role to assume for Route53 changes, e.g. in a central DNS account")
+	flag.StringVar(&externalID, "externalid", "", "External ID to pass when assuming -assumerole")
+	flag.StringVar(&region, "region", "", "AWS region, overrides the default region configuration")
+	flag.StringVar(&profile, "profile", "", "AWS shared config profile to load the credentials and region from, like AWS_PROFILE")
+	flag.StringVar(&accessKey, "accesskey", "", "Static AWS access key ID to use instead of the default credential chain, e.g. on premises or in CI")
+	flag.StringVar(&secretKey, "secretkey", "", "Static AWS secret access key of -accesskey")
+	flag.StringVar(&sessionToken, "sessiontoken", "", "Session token of temporary -accesskey credentials")
+	flag.StringVar(&endpoint, "endpoint", "", "Custom Route53 (and STS) endpoint URL, e.g. for LocalStack")
 	flag.IntVar(&dnsTTL, "dnsttl", 10, "Timeout for DNS entry")
-	flag.StringVar(&ipAddress, "ipaddress", "public-ipv4", "IP Address for A Record")
+	flag.IntVar(&minTTL, "minttl", 0, "Raise any TTL below this to it, to protect against a costly flood of DNS queries")
+	flag.BoolVar(&rejectLowTTL, "rejectlowttl", false, "Fail at startup when a TTL is below -minttl instead of raising it")
+	flag.StringVar(&ipAddress, "ipaddress", "public-ipv4", "IP Address for A Record, or public-ipv4, private-ipv4, imds:<path> or ecs to fetch it from metadata, file:<path> or stdin to read it; comma separated for one per -hostedzone")
+	flag.StringVar(&ipCIDR, "ipcidr", "", "Only use an ECS metadata address within this CIDR, e.g. 10.0.0.0/16")
+	flag.BoolVar(&dualStack, "dualstack", false, "Register an AAAA record next to the A record, with the IPv6 address from the same ECS or EC2 metadata")
+	flag.StringVar(&recordType, "recordtype", "auto", "DNS record type: A, AAAA, CNAME, SRV, PTR or auto to detect from the IP address")
+	flag.StringVar(&target, "target", "", "Target DNS name for CNAME and SRV records, or hostname for the private DNS name of the task from ECS metadata")
+	flag.IntVar(&srvPriority, "srvpriority", 10, "Priority of the SRV record")
+	flag.IntVar(&srvWeight, "srvweight", 5, "Weight of the SRV record, not to be confused with the routing -weight")
+	flag.IntVar(&srvPort, "srvport", 0, "Port of the SRV record")
+	flag.StringVar(&aliasTarget, "aliastarget", "", "DNS name of an ELB, CloudFront or S3 target to register an alias record for instead of an IP address")
+	flag.StringVar(&aliasZone, "aliaszone", "", "Hosted zone ID of the -aliastarget, e.g. the canonical hosted zone ID of the load balancer")
+	flag.BoolVar(&evaluateTargetHealth, "evaluatetargethealth", false, "Let Route53 check the health of the -aliastarget")
+	flag.StringVar(&routingPolicy, "routingpolicy", routingWeighted, "Route53 routing policy: simple, weighted, multivalue, latency or geolocation")
+	flag.StringVar(&txtValue, "txtvalue", "", "Also register a TXT record with this value, {version} is replaced by the build version")
+	flag.StringVar(&comment, "comment", "route53-sidecar", "Comment of the Route53 change batches, the ECS task ARN is appended when known")
+	flag.StringVar(&stateFile, "statefile", "", "File to record the pending change in, so a restarted sidecar waits for it to be INSYNC first")
+	flag.StringVar(&webhook, "webhook", "", "URL to POST a JSON event to after every successful registration and teardown")
+	flag.StringVar(&setIdentifier, "setidentifier", "", "SetIdentifier of the weighted record, defaults to the record value; ecs-task uses the ID of the ECS task")
+	flag.StringVar(&leaderLock, "leaderlock", "", "Only register while holding this leader lock, dynamodb:<table> for an item in a DynamoDB table with the partition key LockID, or txt for a heartbeat TXT record in the hosted zone")
+	flag.StringVar(&leaderKey, "leaderkey", "", "LockID of the -leaderlock shared by the tasks taking turns, defaults to the -dns names, or _heartbeat.<first -dns name> for txt")
+	flag.DurationVar(&leaderLease, "leaderlease", 0, "How long the -leaderlock is held unless renewed by every -refreshinterval, 0 until released")
+	flag.StringVar(&identifierCheck, "identifiercheck", checkOff, "Check at startup whether records of another value already use our SetIdentifier: off, warn or fail")
+	flag.Int64Var(&weight, "weight", 100, "Weight of the weighted record")
+	flag.StringVar(&weightSource, "weightsource", weightFixed, "Where the weight comes from: fixed for -weight, or ecs-cpu for -weight per vCPU of the ECS task")
+	flag.BoolVar(&deleteFetched, "deletefetched", false, "Tear down the records as they are in the hosted zone, in case the TTL, weight or value changed since they were created")
+	flag.BoolVar(&splitInvalidBatch, "splitinvalidbatch", false, "When Route53 rejects the batch as invalid, submit the records one by one so the valid ones are still applied")
+	flag.BoolVar(&skipUnchanged, "skipunchanged", false, "Look up the existing records first and skip the change when they are already up to date")
+	flag.BoolVar(&overwriteConflicting, "overwriteconflicting", false, "Replace an existing record of another type, e.g. a CNAME, that Route53 does not allow next to ours, in a single change batch")
+	flag.BoolVar(&deleteStale, "deletestale", false, "Delete records of the DNS name left behind by tasks that were killed without teardown, see the README")
+	flag.StringVar(&geo, "geo", "", "Location of the geolocation record: continent=EU, country=US, country=US,subdivision=CA or * for the default")
+	flag.BoolVar(&printVersion, "version", false, "Print the version and exit")
 	flag.BoolVar(&register, "register", false, "Register DNS and exit")
 	flag.BoolVar(&unRegister, "unregister", false, "Unregister DNS and exit")
-	flag.Parse()
+	flag.BoolVar(&once, "once", false, "Register DNS and exit 0 without handling signals, e.g. as an init job; see -wait")
+	flag.BoolVar(&failOnStopped, "failonstopped", false, "Exit with an error instead of 0 when the ECS task is already stopping")
+	flag.BoolVar(&skipTTLWait, "skipttlwait", false, "Exit right after the record is deleted instead of waiting for the DNS TTL to expire")
+	flag.BoolVar(&waitRemainingTTL, "waitremainingttl", false, "Only wait what remains of the DNS TTL since the last upsert on teardown, instead of the full TTL")
+	flag.BoolVar(&noTeardown, "noteardown", false, "Keep the DNS records when stopped, for the next task to take over")
+	flag.BoolVar(&fastTeardown, "fastteardown", false, "Exit as soon as the delete is submitted, without waiting for it to be INSYNC or for the DNS TTL")
+	flag.BoolVar(&waitSync, "wait", true, "Wait for the registration to be INSYNC, teardown always waits")
+	flag.BoolVar(&dryRun, "dryrun", false, "Log the Route53 changes instead of applying them")
+	flag.StringVar(&output, "output", outputText, "How -dryrun shows the changes: text logs them, json writes them to stdout for the AWS CLI")
+	flag.IntVar(&maxRetries, "maxretries", 5, "Maximum number of retries for transient Route53 errors")
+	flag.DurationVar(&retryBaseDelay, "retrybasedelay", 500*time.Millisecond, "Base delay for the exponential retry backoff")
+	flag.DurationVar(&imdsTimeout, "imdstimeout", 2*time.Second, "Timeout for EC2 instance metadata requests")
+	flag.DurationVar(&ecsTimeout, "ecstimeout", time.Second, "Timeout for ECS task metadata requests")
+	flag.StringVar(&container, "container", "", "Name of the container of the task whose network the ECS metadata addresses are taken from, all of them by default")
+	flag.IntVar(&metadataRetries, "metadataretries", 3, "Maximum number of retries for failed EC2 and ECS metadata requests")
+	flag.DurationVar(&apiTimeout, "apitimeout", 30*time.Second, "Timeout for each Route53 API call, a timed out call is retried; 0 for none")
+	flag.DurationVar(&syncPollInterval, "syncpollinterval", 5*time.Second, "Interval between checks whether a change is INSYNC")
+	flag.DurationVar(&syncPollMax, "syncpollmax", 0, "Double the -syncpollinterval after every check up to this, 0 keeps it fixed")
+	flag.DurationVar(&syncTimeout, "synctimeout", 5*time.Minute, "Maximum time to wait for a change to be INSYNC, 0 to wait forever")
+	flag.DurationVar(&stopPoll, "stoppollinterval", 0, "Poll the ECS task metadata this often and tear down as soon as the task is being stopped, 0 disables")
+	flag.IntVar(&syncMaxFailures, "syncmaxfailures", 3, "How many throttled status checks to tolerate while waiting for INSYNC, other errors fail right away")
+	flag.DurationVar(&setupDelay, "setupdelay", 0, "Delay before registering DNS, e.g. to let the application start")
+	flag.DurationVar(&startupJitter, "startupjitter", 0, "Wait a random duration up to this after -setupdelay, to spread the Route53 calls of tasks started together")
+	flag.StringVar(&waitPort, "waitforport", "", "Only register DNS once the application accepts TCP connections on this host:port, or port on localhost")
+	flag.DurationVar(&waitPortTimeout, "waitforporttimeout", 5*time.Minute, "How long to wait for -waitforport before failing, 0 waits forever")
+	flag.DurationVar(&readyTimeout, "readytimeout", 0, "Bound the total wait of -setupdelay, -startupjitter and -waitforport, 0 waits as long as they do")
+	flag.StringVar(&readyAction, "readytimeoutaction", readyFail, "What to do when -readytimeout expires: fail or register anyway")
+	flag.DurationVar(&refreshInterval, "refreshinterval", 0, "Interval to re-assert the DNS record while running, 0 to disable")
+	flag.BoolVar(&ipRefresh, "iprefresh", true, "Fetch an -ipaddress from metadata or a file again on every refresh, false keeps the address of the startup")
+	flag.IntVar(&healthPort, "healthport", 0, "Port to serve the /healthz liveness and /ready readiness checks on while running, 0 to disable")
+	flag.IntVar(&metricsPort, "metricsport", 0, "Port to serve Prometheus /metrics on while running, 0 to disable")
+	flag.StringVar(&logLevel, "loglevel", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&logFormat, "logformat", "text", "Log format: text or json")
+	flag.BoolVar(&quiet, "quiet", false, "Only log errors, overriding -loglevel")
+}
+
+// parseFlags defines and parses the flags and their environment variables from args, without the command name,
+// into a new flag.CommandLine so every flag starts from its default
+func parseFlags(args []string) error {
+	// Our -config accepts YAML or JSON, disable the key=value config file parsing of namsral/flag
+	flag.DefaultConfigFlagname = ""
+	flag.CommandLine = flag.NewFlagSet("route53-sidecar", flag.ContinueOnError)
+	defineFlags()
+	return flag.CommandLine.Parse(args)
+}
+
+// configureFromFlags loads the -config file, resolves the IP addresses and hosted zones and returns a registrar per zone
+func configureFromFlags(ctx context.Context) (registrars, error) {
+	if configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			return nil, fmt.Errorf("failed to load config file: %w", err)
+		}
+	}
+
+	lvl, err := parseLogLevel(logLevel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	if quiet {
+		lvl = levelError
+	}
+	log.SetLevel(lvl)
+	if err := log.SetFormat(logFormat); err != nil {
+		return nil, fmt.Errorf("invalid log format: %w", err)
+	}
+
+	recordType = strings.ToUpper(recordType)
+	routingPolicy = strings.ToLower(routingPolicy)
+	if err := validateRoutingPolicy(routingPolicy); err != nil {
+		return nil, fmt.Errorf("invalid routing policy: %w", err)
+	}
+
+	if readyAction = strings.ToLower(readyAction); readyAction != readyFail && readyAction != readyRegister {
+		return nil, fmt.Errorf("invalid -readytimeoutaction %q: must be %s or %s", readyAction, readyFail, readyRegister)
+	}
+	switch output = strings.ToLower(output); {
+	case output != outputText && output != outputJSON:
+		return nil, fmt.Errorf("invalid -output %q: must be %s or %s", output, outputText, outputJSON)
+	case output == outputJSON && !dryRun:
+		return nil, errors.New("-output json only applies to -dryrun")
+	case output == outputJSON && !register && !unRegister && !once:
+		// Running until a signal writes the upsert and the teardown, which the AWS CLI cannot read as one input
+		return nil, errors.New("-output json needs -register, -unregister or -once, to write a single change batch per hosted zone")
+	}
+
+	vpcCheck, identifierCheck = strings.ToLower(vpcCheck), strings.ToLower(identifierCheck)
+	if err := validateCheckMode("-vpccheck", vpcCheck); err != nil {
+		return nil, err
+	}
+	if err := validateCheckMode("-identifiercheck", identifierCheck); err != nil {
+		return nil, err
+	}
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := loadAWSConfig(ctx)
 	if err != nil {
-		log.Fatalf("Failed to initialize aws config: %v", err)
+		return nil, fmt.Errorf("failed to initialize aws config: %w", err)
+	}
+	if region == "" {
+		region = cfg.Region
+	}
+
+	switch routingPolicy {
+	case routingLatency:
+		if region == "" {
+			log.Info("Fetching the region from EC2 instance metadata")
+			if region, err = getImdsValue(ctx, newImdsClient(cfg), "placement/region", "-region"); err != nil {
+				return nil, fmt.Errorf("latency routing needs the region of this task: %w", err)
+			}
+			cfg.Region = region
+		}
+	case routingGeolocation:
+		if geoLocation, err = parseGeoLocation(geo); err != nil {
+			return nil, fmt.Errorf("invalid -geo: %w", err)
+		}
+	}
+
+	if aliasTarget != "" {
+		if aliasZone == "" {
+			return nil, errors.New("alias records require the -aliaszone of the -aliastarget")
+		}
+	} else if hasTarget(types.RRType(recordType)) {
+		if target == "" {
+			return nil, fmt.Errorf("record type %s requires a -target DNS name", recordType)
+		}
+		if target == targetHostname {
+			if target, err = lookupHostname(ctx); err != nil {
+				return nil, fmt.Errorf("invalid -target %s: %w", targetHostname, err)
+			}
+		}
+	}
+
+	if dualStack && (aliasTarget != "" || (recordType != "AUTO" && recordType != string(types.RRTypeA))) {
+		return nil, fmt.Errorf("-dualstack registers an A and an AAAA record, it does not work with -recordtype %s or -aliastarget", recordType)
+	}
+
+	var task *ecsMetadata
+	if os.Getenv("ECS_CONTAINER_METADATA_URI_V4") != "" {
+		if task, err = getEcsTaskMetadata(ctx); err != nil {
+			log.Debugf("Unable to get the ECS task ARN: %v", err)
+		} else {
+			taskARN = task.TaskARN
+		}
+	}
+
+	if stopPoll > 0 && os.Getenv("ECS_CONTAINER_METADATA_URI_V4") == "" {
+		return nil, errors.New("-stoppollinterval needs the ECS task metadata, ECS_CONTAINER_METADATA_URI_V4 is not set")
+	}
+
+	switch strings.ToLower(weightSource) {
+	case weightFixed:
+	case weightECSCPU:
+		if task == nil {
+			return nil, errors.New("-weightsource ecs-cpu needs the ECS task metadata")
+		}
+		if weight, err = cpuWeight(weight, task.CPU); err != nil {
+			return nil, fmt.Errorf("invalid -weightsource: %w", err)
+		}
+		log.Infof("Using weight %d for %v vCPUs", weight, task.CPU)
+	default:
+		return nil, fmt.Errorf("invalid -weightsource %q: must be %s or %s", weightSource, weightFixed, weightECSCPU)
+	}
+
+	if strings.EqualFold(setIdentifier, identifierECSTask) {
+		if task == nil {
+			return nil, errors.New("-setidentifier ecs-task needs the ECS task metadata")
+		}
+		if setIdentifier, err = taskID(task.TaskARN); err != nil {
+			return nil, fmt.Errorf("invalid -setidentifier: %w", err)
+		}
 	}
 
-	if ipAddress == "public-ipv4" {
-		log.Printf("Fetching IP Address from EC2 public-ipv4")
+	r53 := newRoute53Client(cfg)
 
-		client := imds.NewFromConfig(cfg)
-		output, err := client.GetMetadata(ctx, &imds.GetMetadataInput{Path: "public-ipv4"})
+	zones := splitList(hostedZone)
+	if len(zones) == 0 {
+		if zoneName == "" {
+			return nil, errors.New("either -hostedzone or -hostedzonename is required")
+		}
+		zone, err := lookupHostedZone(ctx, r53, zoneName, privateZone)
 		if err != nil {
-			log.Fatalf("Unable to retrieve the public IPv4 address from the EC2 metadata: %s\n", err)
+			return nil, fmt.Errorf("failed to look up hosted zone: %w", err)
+		}
+		zones = []string{zone}
+		hostedZone = zone
+	} else if !skipZoneCheck {
+		for _, zone := range zones {
+			if err := checkHostedZone(ctx, r53, zone); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if vpcCheck != checkOff {
+		if err := checkZonesVPC(ctx, cfg, r53, zones); err != nil {
+			if vpcCheck == checkFail {
+				return nil, err
+			}
+			log.Warnf("%v", err)
+		}
+	}
+
+	var locker Locker
+	if leaderLock != "" {
+		if leaderLease > 0 && !register && !unRegister && !once && (refreshInterval <= 0 || refreshInterval >= leaderLease) {
+			return nil, fmt.Errorf("-leaderlease %v needs a shorter -refreshinterval to renew the lock while running", leaderLease)
+		}
+		if leaderLock == leaderLockTXT {
+			if names := dnsNames(); leaderKey == "" && len(names) > 0 {
+				leaderKey = heartbeatName(names[0])
+			}
+			locker, err = newHeartbeatLocker(r53, zones[0], leaderKey, lockOwner(taskARN), leaderLease)
+		} else {
+			if leaderKey == "" {
+				leaderKey = strings.Join(dnsNames(), ",")
+			}
+			locker, err = newLeaderLocker(cfg, leaderLock, leaderKey, lockOwner(taskARN), leaderLease)
 		}
-		publicIpv4, err := io.ReadAll(output.Content)
 		if err != nil {
-			log.Fatalf("Failed to fetch IPV4 public IP: %v", err)
+			return nil, err
+		}
+	}
+
+	sources := splitList(ipAddress)
+	if len(sources) == 0 {
+		sources = []string{""} // left to validate, unless a -target or -aliastarget is used
+	}
+	// With a single hosted zone all the values go in one record, otherwise there is one per zone
+	zoneSources := [][]string{sources}
+	if len(zones) > 1 {
+		if len(sources) != 1 && len(sources) != len(zones) {
+			return nil, fmt.Errorf("got %d -ipaddress values for %d hosted zones, want one or one per zone", len(sources), len(zones))
+		}
+		zoneSources = nil
+		for i := range zones {
+			zoneSources = append(zoneSources, sources[min(i, len(sources)-1):][:1])
+		}
+	}
+
+	ttls, err := dnsTTLs()
+	if err != nil {
+		return nil, err
+	}
+
+	var rs registrars
+	var addresses []string
+	for i, zone := range zones {
+		source := zoneSources[i][0]
+		address := source
+		var src IPSource
+		var resolve func(context.Context) (string, error)
+		var extra []string
+		var ipv6 string
+		if aliasTarget == "" && !hasTarget(types.RRType(recordType)) {
+			if src, err = newIPSource(cfg, source); err != nil {
+				return nil, err
+			}
+			if dualStack {
+				v6, err := ipv6Source(src)
+				if err != nil {
+					return nil, fmt.Errorf("invalid -dualstack: %w", err)
+				}
+				if src, address, ipv6, err = resolveDualStack(ctx, src, v6); err != nil {
+					return nil, err
+				}
+			} else if address, err = src.Resolve(ctx); err != nil {
+				return nil, err
+			}
+			if ipRefresh && refreshable(src) {
+				resolve = src.Resolve
+			}
+			for _, value := range zoneSources[i][1:] {
+				src, err := newIPSource(cfg, value)
+				if err != nil {
+					return nil, err
+				}
+				ip, err := src.Resolve(ctx)
+				if err != nil {
+					return nil, err
+				}
+				extra = append(extra, ip)
+			}
+		}
+		addresses = append(append(addresses, address), extra...)
+
+		r := &Registrar{
+			API:                  r53,
+			Names:                dnsNames(),
+			TTLs:                 ttls,
+			HostedZone:           zone,
+			TTL:                  dnsTTL,
+			MinTTL:               minTTL,
+			RejectLowTTL:         rejectLowTTL,
+			RecordType:           types.RRType(recordType),
+			IPAddress:            address,
+			ResolveIP:            resolve,
+			IPSource:             src,
+			ExtraIPAddresses:     extra,
+			IPv6Address:          ipv6,
+			Target:               target,
+			AliasTarget:          aliasTarget,
+			AliasZone:            aliasZone,
+			EvaluateTargetHealth: evaluateTargetHealth,
+			SRVPriority:          srvPriority,
+			SRVWeight:            srvWeight,
+			SRVPort:              srvPort,
+			TXTValue:             txtValue,
+			Comment:              changeComment(comment, taskARN),
+			Webhook:              webhook,
+			StateFile:            zoneStateFile(stateFile, zone, len(zones)),
+			RoutingPolicy:        routingPolicy,
+			SetIdentifier:        setIdentifier,
+			DeleteStale:          deleteStale,
+			OverwriteConflicting: overwriteConflicting,
+			SkipUnchanged:        skipUnchanged,
+			SplitInvalidBatch:    splitInvalidBatch,
+			DeleteFetched:        deleteFetched,
+			Locker:               locker,
+			Weight:               weight,
+			Region:               region,
+			GeoLocation:          geoLocation,
+			DryRun:               dryRun,
+			Wait:                 waitSync,
+			SkipTTLWait:          skipTTLWait,
+			WaitRemainingTTL:     waitRemainingTTL,
+			FastTeardown:         fastTeardown,
+			NoTeardown:           noTeardown,
+			SetupDelay:           setupDelay,
+			StartupJitter:        startupJitter,
+			WaitForPort:          portAddress(waitPort),
+			WaitForPortTimeout:   waitPortTimeout,
+			ReadyTimeout:         readyTimeout,
+			RegisterUnready:      readyAction == readyRegister,
+			RefreshInterval:      refreshInterval,
+			MaxRetries:           maxRetries,
+			RetryBaseDelay:       retryBaseDelay,
+			SyncPollInterval:     syncPollInterval,
+			SyncPollMax:          syncPollMax,
+			SyncTimeout:          syncTimeout,
+			APITimeout:           apiTimeout,
+			SyncMaxFailures:      syncMaxFailures,
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+
+		if aliasTarget != "" {
+			r.RecordType, err = resolveAliasRecordType(recordType)
+		} else if dualStack {
+			r.RecordType, err = resolveRecordType("auto", address) // AAAA when only the IPv6 address was found
+		} else {
+			r.RecordType, err = resolveRecordType(recordType, address)
 		}
-		ipAddress = string(publicIpv4)
-	} else if ipAddress == "ecs" {
-		log.Printf("Fetching IP Address from ECS metadata")
-		metadata, err := getEcsMetadata()
 		if err != nil {
-			log.Fatalf("Failed to fetch ECS metadata: %v", err)
+			return nil, fmt.Errorf("invalid record type: %w", err)
 		}
-		ipAddress = metadata.Networks[0].IPv4Addresses[0] // use the first IP address
-		if metadata.DesiredStatus == "STOPPED" {
-			log.Fatalf("ECS container is being stopped, exiting")
+		if identifierCheck != checkOff && !unRegister && routingPolicy != routingSimple {
+			if err := r.checkIdentifier(ctx); errors.Is(err, errIdentifierCollision) && identifierCheck == checkFail {
+				return nil, err
+			} else if err != nil {
+				log.Warnf("%v", err)
+			}
 		}
+		rs = append(rs, r)
 	}
+	if locker != nil && len(rs) > 1 {
+		// The zones share the one lock, it is only released once the last of them is torn down
+		shared := newSharedLocker(locker)
+		for _, r := range rs {
+			r.Locker = shared.forZone()
+		}
+	}
+	ipAddress = strings.Join(addresses, ",")
+	recordType = string(rs[0].RecordType)
 
-	r53 = route53.NewFromConfig(cfg)
+	return rs, nil
 }
 
-func dumpConfig() {
-	log.Printf("Version=%v", version)
-	log.Printf("DNS=%v", dns)
-	log.Printf("DNSTTL=%v", dnsTTL)
-	log.Printf("HOSTEDZONE=%v", hostedZone)
-	log.Printf("IPADDRESS=%v", ipAddress)
+// checkHostedZone fails early when the hosted zone does not exist or is not accessible, rather than on the first change
+func checkHostedZone(ctx context.Context, r53 route53API, zone string) error {
+	err := retryWithBackoff(ctx, maxRetries, retryBaseDelay, isTransientError, func() error {
+		return callWithTimeout(ctx, apiTimeout, func(ctx context.Context) error {
+			_, err := r53.GetHostedZone(ctx, &route53.GetHostedZoneInput{Id: aws.String(zone)})
+			return err
+		})
+	})
+	switch err = classifyAPIError(err); {
+	case err == nil:
+		return nil
+	case errors.Is(err, errHostedZoneNotFound):
+		return fmt.Errorf("hosted zone %s does not exist, check -hostedzone: %w", zone, err)
+	case errors.Is(err, errAccessDenied):
+		return fmt.Errorf("not allowed to get hosted zone %s, grant route53:GetHostedZone on it or set -skipzonecheck: %w", zone, err)
+	}
+	return fmt.Errorf("unable to check hosted zone %s: %w", zone, err)
 }
 
-func tearDownDNS(ctx context.Context) {
-	log.Printf("Tearing down Route 53 DNS Name A %s => %s", dns, ipAddress)
-	input := &route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &types.ChangeBatch{
-			Changes: []types.Change{
-				{
-					Action: types.ChangeActionDelete,
-					ResourceRecordSet: &types.ResourceRecordSet{
-						Name: aws.String(dns),
-						ResourceRecords: []types.ResourceRecord{
-							{
-								Value: aws.String(ipAddress),
-							},
-						},
-						TTL:           aws.Int64(int64(dnsTTL)),
-						Type:          types.RRTypeA,
-						Weight:        aws.Int64(100),
-						SetIdentifier: aws.String(ipAddress),
-					},
-				},
-			},
-		},
-		HostedZoneId: aws.String(hostedZone),
+// Formats of the -output of a dry run
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Actions of the -readytimeoutaction
+const (
+	readyFail     = "fail"
+	readyRegister = "register"
+)
+
+// Modes of the -vpccheck and -identifiercheck startup checks
+const (
+	checkOff  = "off"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// validateCheckMode checks the mode of a startup check flag
+func validateCheckMode(flagName, mode string) error {
+	if mode != checkOff && mode != checkWarn && mode != checkFail {
+		return fmt.Errorf("invalid %s %q: must be %s, %s or %s", flagName, mode, checkOff, checkWarn, checkFail)
+	}
+	return nil
+}
+
+// checkZonesVPC fails when one of the zones is a private hosted zone which is not associated with the VPC of this task,
+// the records would not resolve in it
+func checkZonesVPC(ctx context.Context, cfg aws.Config, r53 route53API, zones []string) error {
+	vpc := vpcID
+	if vpc == "" {
+		log.Info("Fetching the VPC from EC2 instance metadata")
+		var err error
+		if vpc, err = imdsVPCID(ctx, newImdsClient(cfg)); err != nil {
+			return fmt.Errorf("unable to check the VPC of the private hosted zones: %w", err)
+		}
 	}
+	for _, zone := range zones {
+		if err := checkZoneVPC(ctx, r53, zone, vpc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	changeSet, err := r53.ChangeResourceRecordSets(ctx, input)
+// imdsVPCID fetches the VPC of the primary network interface from EC2 instance metadata
+func imdsVPCID(ctx context.Context, client imdsAPI) (string, error) {
+	mac, err := getImdsValue(ctx, client, "mac", "-vpcid")
+	if err != nil {
+		return "", err
+	}
+	return getImdsValue(ctx, client, "network/interfaces/macs/"+mac+"/vpc-id", "-vpcid")
+}
 
+// checkZoneVPC fails when zone is a private hosted zone which is not associated with vpc, public zones resolve everywhere
+func checkZoneVPC(ctx context.Context, r53 route53API, zone, vpc string) error {
+	var output *route53.GetHostedZoneOutput
+	err := retryWithBackoff(ctx, maxRetries, retryBaseDelay, isTransientError, func() error {
+		return callWithTimeout(ctx, apiTimeout, func(ctx context.Context) (err error) {
+			output, err = r53.GetHostedZone(ctx, &route53.GetHostedZoneInput{Id: aws.String(zone)})
+			return err
+		})
+	})
 	if err != nil {
-		log.Fatalf("Failed to delete DNS, exiting: %v", err.Error())
-	}
-
-	log.Print("Request sent to Route 53...")
-	waitForSync(ctx, changeSet)
-
-	// Then wait the DNS Timeout to expire
-	log.Printf("Waiting for DNS Timeout to expire (%d seconds)", dnsTTL)
-	time.Sleep(time.Duration(dnsTTL) * time.Second)
-	log.Print("DNS Timeout expiry finished")
-}
-
-func setupDNS(ctx context.Context) {
-	log.Printf("Setting up Route 53 DNS Name A %s => %s", dns, ipAddress)
-
-	input := &route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &types.ChangeBatch{
-			Changes: []types.Change{
-				{
-					Action: types.ChangeActionUpsert,
-					ResourceRecordSet: &types.ResourceRecordSet{
-						Name: aws.String(dns),
-						ResourceRecords: []types.ResourceRecord{
-							{
-								Value: aws.String(ipAddress),
-							},
-						},
-						TTL:           aws.Int64(int64(dnsTTL)),
-						Type:          types.RRTypeA,
-						Weight:        aws.Int64(100),
-						SetIdentifier: aws.String(ipAddress),
-					},
-				},
-			},
-			Comment: aws.String("route53-sidecar"),
-		},
-		HostedZoneId: aws.String(hostedZone),
-	}
-
-	changeSet, err := r53.ChangeResourceRecordSets(ctx, input)
+		return fmt.Errorf("unable to get the VPCs of hosted zone %s: %w", zone, err)
+	}
+	if output.HostedZone == nil || output.HostedZone.Config == nil || !output.HostedZone.Config.PrivateZone {
+		return nil
+	}
+	var associated []string
+	for _, v := range output.VPCs {
+		if aws.ToString(v.VPCId) == vpc {
+			return nil
+		}
+		associated = append(associated, aws.ToString(v.VPCId))
+	}
+	return fmt.Errorf("private hosted zone %s is not associated with VPC %s of this task but with [%s], its records will not resolve here; associate the VPC with the zone or check -hostedzone",
+		zone, vpc, strings.Join(associated, ","))
+}
+
+// lookupHostedZone resolves a zone name to its ID, preferring the zone whose privacy matches private
+func lookupHostedZone(ctx context.Context, r53 route53API, name string, private bool) (string, error) {
+	name = strings.TrimSuffix(name, ".") + "."
+	var output *route53.ListHostedZonesByNameOutput
+	err := callWithTimeout(ctx, apiTimeout, func(ctx context.Context) (err error) {
+		output, err = r53.ListHostedZonesByName(ctx, &route53.ListHostedZonesByNameInput{DNSName: aws.String(name)})
+		return err
+	})
 	if err != nil {
-		log.Printf("Failed to create DNS: %v", err.Error())
+		return "", classifyAPIError(err)
+	}
+
+	var matches []types.HostedZone
+	for _, zone := range output.HostedZones {
+		if aws.ToString(zone.Name) == name {
+			matches = append(matches, zone)
+		}
+	}
+	for _, zone := range matches {
+		if zone.Config != nil && zone.Config.PrivateZone == private {
+			return strings.TrimPrefix(aws.ToString(zone.Id), "/hostedzone/"), nil
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no hosted zone named %q: %w", name, errHostedZoneNotFound)
+	case 1:
+		return strings.TrimPrefix(aws.ToString(matches[0].Id), "/hostedzone/"), nil
+	default:
+		return "", fmt.Errorf("%d hosted zones named %q, none with private=%v", len(matches), name, private)
+	}
+}
+
+func dumpConfig(rs registrars) {
+	if strings.EqualFold(logFormat, "json") {
+		log.With("config", newConfigDump(rs)).Info("Effective configuration")
 		return
 	}
+	log.Infof("Version=%v", version)
+	log.Infof("DNS=%v", dns)
+	log.Infof("DOMAINSUFFIX=%v", domainSuffix)
+	log.Infof("DNSTTL=%v", dnsTTL)
+	log.Infof("MINTTL=%v", minTTL)
+	log.Infof("REJECTLOWTTL=%v", rejectLowTTL)
+	log.Infof("HOSTEDZONE=%v", hostedZone)
+	log.Infof("SKIPZONECHECK=%v", skipZoneCheck)
+	log.Infof("VPCCHECK=%v", vpcCheck)
+	log.Infof("VPCID=%v", vpcID)
+	log.Infof("ASSUMEROLE=%v", assumeRole)
+	log.Infof("REGION=%v", region)
+	log.Infof("PROFILE=%v", profile)
+	log.Infof("ACCESSKEY=%v", accessKey) // the secret key and session token are never logged
+	log.Infof("ENDPOINT=%v", endpoint)
+	log.Infof("IPADDRESS=%v", ipAddress)
+	log.Infof("IPCIDR=%v", ipCIDR)
+	log.Infof("DUALSTACK=%v", dualStack)
+	log.Infof("RECORDTYPE=%v", recordType)
+	log.Infof("TARGET=%v", target)
+	log.Infof("SRVPRIORITY=%v", srvPriority)
+	log.Infof("SRVWEIGHT=%v", srvWeight)
+	log.Infof("SRVPORT=%v", srvPort)
+	log.Infof("ALIASTARGET=%v", aliasTarget)
+	log.Infof("ALIASZONE=%v", aliasZone)
+	log.Infof("EVALUATETARGETHEALTH=%v", evaluateTargetHealth)
+	log.Infof("TXTVALUE=%v", txtValue)
+	log.Infof("COMMENT=%v", rs[0].Comment)
+	log.Infof("WEBHOOK=%v", redactURL(webhook))
+	log.Infof("STATEFILE=%v", stateFile)
+	log.Infof("ROUTINGPOLICY=%v", routingPolicy)
+	for _, r := range rs {
+		log.Infof("SETIDENTIFIER=%v (%s)", r.recordSetIdentifier(), r.HostedZone)
+	}
+	log.Infof("IDENTIFIERCHECK=%v", identifierCheck)
+	log.Infof("LEADERLOCK=%v", leaderLock)
+	log.Infof("LEADERKEY=%v", leaderKey)
+	log.Infof("LEADERLEASE=%v", leaderLease)
+	log.Infof("WEIGHT=%v", weight)
+	log.Infof("WEIGHTSOURCE=%v", weightSource)
+	log.Infof("DELETESTALE=%v", deleteStale)
+	log.Infof("OVERWRITECONFLICTING=%v", overwriteConflicting)
+	log.Infof("SKIPUNCHANGED=%v", skipUnchanged)
+	log.Infof("SPLITINVALIDBATCH=%v", splitInvalidBatch)
+	log.Infof("DELETEFETCHED=%v", deleteFetched)
+	log.Infof("GEO=%v", geo)
+	log.Infof("MAXRETRIES=%v", maxRetries)
+	log.Infof("RETRYBASEDELAY=%v", retryBaseDelay)
+	log.Infof("CONTAINER=%v", container)
+	log.Infof("IMDSTIMEOUT=%v", imdsTimeout)
+	log.Infof("ECSTIMEOUT=%v", ecsTimeout)
+	log.Infof("METADATARETRIES=%v", metadataRetries)
+	log.Infof("APITIMEOUT=%v", apiTimeout)
+	log.Infof("SETUPDELAY=%v", setupDelay)
+	log.Infof("STARTUPJITTER=%v", startupJitter)
+	log.Infof("WAITFORPORT=%v", waitPort)
+	log.Infof("WAITFORPORTTIMEOUT=%v", waitPortTimeout)
+	log.Infof("READYTIMEOUT=%v", readyTimeout)
+	log.Infof("READYTIMEOUTACTION=%v", readyAction)
+	log.Infof("REFRESHINTERVAL=%v", refreshInterval)
+	log.Infof("IPREFRESH=%v", ipRefresh)
+	log.Infof("HEALTHPORT=%v", healthPort)
+	log.Infof("METRICSPORT=%v", metricsPort)
+	log.Infof("WAIT=%v", waitSync)
+	log.Infof("SYNCPOLLINTERVAL=%v", syncPollInterval)
+	log.Infof("SYNCPOLLMAX=%v", syncPollMax)
+	log.Infof("SYNCTIMEOUT=%v", syncTimeout)
+	log.Infof("SYNCMAXFAILURES=%v", syncMaxFailures)
+	log.Infof("STOPPOLLINTERVAL=%v", stopPoll)
+	log.Infof("SKIPTTLWAIT=%v", skipTTLWait)
+	log.Infof("WAITREMAININGTTL=%v", waitRemainingTTL)
+	log.Infof("FASTTEARDOWN=%v", fastTeardown)
+	log.Infof("NOTEARDOWN=%v", noTeardown)
+	log.Infof("DRYRUN=%v", dryRun)
+	log.Infof("OUTPUT=%v", output)
+	log.Infof("LOGLEVEL=%v", logLevel)
+	log.Infof("LOGFORMAT=%v", logFormat)
+	log.Infof("QUIET=%v", quiet)
+}
 
-	log.Print("Request sent to Route 53...")
-	waitForSync(ctx, changeSet)
+// dnsNames splits the comma separated -dns flag into individual names, dropping any name=ttl override
+func dnsNames() []string {
+	var names []string
+	for _, entry := range splitList(dns) {
+		name, _, _ := strings.Cut(entry, "=")
+		names = append(names, punycodeName(qualifyName(strings.TrimSpace(name), domainSuffix)))
+	}
+	return names
 }
 
-func waitForSync(ctx context.Context, changeSet *route53.ChangeResourceRecordSetsOutput) {
-	failures := 0
-	for {
-		if err := SleepWithContext(ctx, 5*time.Second); err != nil {
-			log.Print("Context cancelled, stop waiting for Route53 ChangeSet to propogate")
-			return
+// qualifyName appends suffix to a short name, one without any dot, other names are used as given
+func qualifyName(name, suffix string) string {
+	if suffix == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return name + "." + strings.TrimPrefix(suffix, ".")
+}
+
+// punycodeName converts the internationalized labels of name to their xn-- form, as Route53 only takes ASCII names.
+// ASCII labels are left alone, so wildcards and underscores keep working, and a label that cannot be converted is
+// left for validateDomainName to reject.
+func punycodeName(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			if ascii, err := idna.Lookup.ToASCII(label); err == nil {
+				labels[i] = ascii
+			}
 		}
+	}
+	return strings.Join(labels, ".")
+}
 
-		changeOutput, err := r53.GetChange(ctx, &route53.GetChangeInput{
-			Id: changeSet.ChangeInfo.Id,
-		})
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
 
-		if err != nil {
-			log.Printf("Failed getting ChangeSet result: %v", err)
-			if failures++; failures > 3 {
-				log.Fatal("Failed the maximum times getting changeset, exiting")
-			}
+// dnsTTLs returns the TTL overrides of the name=ttl entries of the -dns flag
+func dnsTTLs() (map[string]int, error) {
+	ttls := map[string]int{}
+	for _, entry := range splitList(dns) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
 			continue
 		}
+		ttl, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid -dns TTL of %s: %w", name, err)
+		}
+		ttls[punycodeName(qualifyName(strings.TrimSpace(name), domainSuffix))] = ttl
+	}
+	return ttls, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty elements
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// sameDomainName compares names the way Route53 does, ignoring case, the trailing dot and the octal escaped wildcard
+func sameDomainName(a, b string) bool {
+	normalize := func(name string) string {
+		return strings.TrimSuffix(strings.ReplaceAll(strings.ToLower(name), `\052`, "*"), ".")
+	}
+	return normalize(a) == normalize(b)
+}
+
+// targetHostname uses the host name of the task as the -target, e.g. for a CNAME chain to the DNS name of its ENI
+const targetHostname = "hostname"
+
+// lookupHostname returns the private DNS name of the task from the ECS metadata, or the host name outside of ECS
+func lookupHostname(ctx context.Context) (string, error) {
+	var hostname string
+	if os.Getenv("ECS_CONTAINER_METADATA_URI_V4") != "" {
+		log.Info("Fetching the host name from ECS metadata")
+		var err error
+		if hostname, err = getEcsHostname(ctx); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return "", fmt.Errorf("unable to get the host name: %w", err)
+		}
+	}
+	if err := validateDomainName(hostname); err != nil {
+		return "", fmt.Errorf("host name %q does not look resolvable, pass an explicit -target: %w", hostname, err)
+	}
+	return hostname, nil
+}
+
+// hasTarget reports whether records of type rt point at -target instead of an IP address
+func hasTarget(rt types.RRType) bool {
+	switch rt {
+	case types.RRTypeCname, types.RRTypeSrv:
+		return true
+	}
+	return false
+}
+
+// Sources of the weight of weighted records
+const (
+	weightFixed  = "fixed"
+	weightECSCPU = "ecs-cpu"
+)
+
+// maxWeight is the largest weight Route53 accepts
+const maxWeight = 255
+
+// cpuWeight scales the weight per vCPU to the vCPUs of the task, rounded and capped at maxWeight.
+// The weight is computed once at startup, so teardown deletes the record with the weight it was created with.
+func cpuWeight(perCPU int64, vcpus float64) (int64, error) {
+	if vcpus <= 0 {
+		return 0, errors.New("the ECS task metadata has no task CPU limit")
+	}
+	weight := int64(math.Round(float64(perCPU) * vcpus))
+	return min(max(weight, 1), maxWeight), nil
+}
+
+// identifierECSTask uses the ID of the ECS task as the SetIdentifier, so it stays unique even when a new task gets the IP of an old one
+const identifierECSTask = "ecs-task"
+
+// taskID returns the last part of an ECS task ARN, e.g. arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c
+func taskID(arn string) (string, error) {
+	_, id, found := strings.Cut(arn, ":task/")
+	if i := strings.LastIndexByte(id, '/'); i >= 0 {
+		id = id[i+1:]
+	}
+	if !found || id == "" {
+		return "", fmt.Errorf("%q is not an ECS task ARN", arn)
+	}
+	return id, nil
+}
+
+// reverseName returns the in-addr.arpa (or ip6.arpa) name of a PTR record for ip
+func reverseName(ip string) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("%q is not a valid IP address", ip)
+	}
+	var labels []string
+	if v4 := addr.To4(); v4 != nil {
+		for i := len(v4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(v4[i])))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa.", nil
+	}
+	const hex = "0123456789abcdef"
+	for i := len(addr) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[addr[i]&0xf]), string(hex[addr[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa.", nil
+}
+
+// srvValue formats an SRV record value as "priority weight port target."
+func srvValue(priority, weight, port int, target string) string {
+	return fmt.Sprintf("%d %d %d %s.", priority, weight, port, strings.TrimSuffix(target, "."))
+}
+
+const (
+	routingSimple      = "simple"
+	routingWeighted    = "weighted"
+	routingMultiValue  = "multivalue"
+	routingLatency     = "latency"
+	routingGeolocation = "geolocation"
+)
+
+func validateRoutingPolicy(policy string) error {
+	switch policy {
+	case routingSimple, routingWeighted, routingMultiValue, routingLatency, routingGeolocation:
+		return nil
+	default:
+		return fmt.Errorf("unsupported routing policy %q", policy)
+	}
+}
+
+// quoteTXT quotes a TXT value per Route53 rules, splitting it into strings of at most 255 characters
+func quoteTXT(value string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	var parts []string
+	for {
+		chunk := value
+		if len(chunk) > 255 {
+			chunk = chunk[:255]
+		}
+		parts = append(parts, `"`+escape.Replace(chunk)+`"`)
+		value = value[len(chunk):]
+		if value == "" {
+			return strings.Join(parts, " ")
+		}
+	}
+}
 
-		if changeOutput.ChangeInfo.Status == "INSYNC" {
-			log.Print("Route53 Change Completed")
-			break
+// parseGeoLocation parses the -geo location, e.g. continent=EU, country=US,subdivision=CA or * for the default location
+func parseGeoLocation(s string) (*types.GeoLocation, error) {
+	if s == "" {
+		return nil, errors.New("geolocation routing requires a location")
+	}
+	if s == "*" {
+		return &types.GeoLocation{CountryCode: aws.String("*")}, nil
+	}
+	loc := &types.GeoLocation{}
+	for _, part := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", part)
 		}
+		value = strings.ToUpper(value)
+		switch strings.ToLower(key) {
+		case "continent":
+			loc.ContinentCode = aws.String(value)
+		case "country":
+			loc.CountryCode = aws.String(value)
+		case "subdivision":
+			loc.SubdivisionCode = aws.String(value)
+		default:
+			return nil, fmt.Errorf("unknown location key %q, want continent, country or subdivision", key)
+		}
+	}
+	if loc.ContinentCode != nil && (loc.CountryCode != nil || loc.SubdivisionCode != nil) {
+		return nil, errors.New("a continent cannot be combined with a country or subdivision")
+	}
+	if loc.SubdivisionCode != nil && loc.CountryCode == nil {
+		return nil, errors.New("a subdivision requires a country")
+	}
+	return loc, nil
+}
+
+// isConflictError reports whether Route53 rejected the change because a record of another type exists
+func isConflictError(err error) bool {
+	var invalidBatch *types.InvalidChangeBatch
+	if !errors.As(err, &invalidBatch) {
+		return false
+	}
+	msg := invalidBatch.ErrorMessage()
+	return strings.Contains(msg, "conflicting RRSet") || strings.Contains(msg, "conflicts with other records")
+}
 
-		log.Printf("Route53 Change not yet propogated (ChangeInfo.Status = %s)...", changeOutput.ChangeInfo.Status)
+// conflictingTypePattern matches the existing record type in Route53's conflict message
+var conflictingTypePattern = regexp.MustCompile(`conflicting RRSet of type (\w+)`)
+
+// conflictingType returns the type of the existing record of a conflict error, "" when Route53 does not name it
+func conflictingType(err error) types.RRType {
+	var invalidBatch *types.InvalidChangeBatch
+	if !errors.As(err, &invalidBatch) {
+		return ""
+	}
+	if m := conflictingTypePattern.FindStringSubmatch(invalidBatch.ErrorMessage()); m != nil {
+		return types.RRType(m[1])
 	}
+	return ""
 }
 
-type ecsMetadata struct {
-	DesiredStatus string `json:"DesiredStatus"`
-	Networks      []struct {
-		IPv4Addresses []string `json:"IPv4Addresses"`
-	} `json:"Networks"`
+// isInvalidBatchError reports whether Route53 rejected the change batch as invalid, e.g. because one of its records is
+func isInvalidBatchError(err error) bool {
+	var invalidBatch *types.InvalidChangeBatch
+	return errors.As(err, &invalidBatch)
 }
 
-func getEcsMetadata() (*ecsMetadata, error) {
-	// Get metadata URI from ECS_CONTAINER_METADATA_URI_V4 or ECS_CONTAINER_METADATA_URI
-	uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
-	if uri == "" {
-		uri = os.Getenv("ECS_CONTAINER_METADATA_URI")
+// isNotFoundError reports whether Route53 rejected a delete because the record set does not exist
+func isNotFoundError(err error) bool {
+	var invalidBatch *types.InvalidChangeBatch
+	return errors.As(err, &invalidBatch) && strings.Contains(invalidBatch.ErrorMessage(), "not found")
+}
+
+// resolveRecordType checks the requested record type against the IP address, "auto" picks A or AAAA
+func resolveRecordType(rt, ip string) (types.RRType, error) {
+	switch rrType := types.RRType(strings.ToUpper(rt)); rrType {
+	case types.RRTypeCname, types.RRTypeSrv:
+		return rrType, nil
 	}
-	client := http.Client{
-		Timeout: 1 * time.Second, // 1 second timeout, same as ec2metadata
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("%q is not a valid IP address", ip)
 	}
-	resp, err := client.Get(uri)
+	isV4 := addr.To4() != nil
+	switch types.RRType(strings.ToUpper(rt)) {
+	case "AUTO", "":
+		if isV4 {
+			return types.RRTypeA, nil
+		}
+		return types.RRTypeAaaa, nil
+	case types.RRTypeA:
+		if !isV4 {
+			return "", fmt.Errorf("record type A requires an IPv4 address, got %q", ip)
+		}
+		return types.RRTypeA, nil
+	case types.RRTypeAaaa:
+		if isV4 {
+			return "", fmt.Errorf("record type AAAA requires an IPv6 address, got %q", ip)
+		}
+		return types.RRTypeAaaa, nil
+	case types.RRTypePtr:
+		return types.RRTypePtr, nil
+	default:
+		return "", fmt.Errorf("unsupported record type %q", rt)
+	}
+}
+
+// resolveAliasRecordType checks the requested record type of an alias record, "auto" picks A
+func resolveAliasRecordType(rt string) (types.RRType, error) {
+	switch types.RRType(strings.ToUpper(rt)) {
+	case "AUTO", "", types.RRTypeA:
+		return types.RRTypeA, nil
+	case types.RRTypeAaaa:
+		return types.RRTypeAaaa, nil
+	default:
+		return "", fmt.Errorf("alias records must be A or AAAA, got %q", rt)
+	}
+}
+
+// logDryRun logs the change that a dry run does not send, or writes it to out when set, as the --cli-input-json
+// of aws route53 change-resource-record-sets
+func logDryRun(input *route53.ChangeResourceRecordSetsInput, out io.Writer) error {
+	b, err := json.MarshalIndent(input, "", "  ")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close()
-	metadata := &ecsMetadata{}
-	if err = json.NewDecoder(resp.Body).Decode(metadata); err != nil {
-		return nil, err
+	if out == nil {
+		log.Infof("Dry run, not sending change to Route 53:\n%s", b)
+		return nil
+	}
+	// The SDK types marshal their unset fields as null or "", which the AWS CLI rejects
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
 	}
-	return metadata, nil
+	if b, err = json.MarshalIndent(omitEmpty(v), "", "  "); err != nil {
+		return err
+	}
+	log.Info("Dry run, not sending change to Route 53, writing it to stdout")
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
+
+// omitEmpty drops the null and empty string values from the objects of a decoded JSON value
+func omitEmpty(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if value == nil || value == "" {
+				delete(v, key)
+			} else {
+				v[key] = omitEmpty(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = omitEmpty(value)
+		}
+	}
+	return v
+}
+
+// changeComment is the comment with the ECS task ARN, if known, for auditing the changes in CloudTrail
+func changeComment(comment, taskARN string) string {
+	c := comment
+	if taskARN != "" {
+		c = strings.TrimSpace(c + " " + taskARN)
+	}
+	if len(c) > 256 { // Route53 limit
+		c = c[:256]
+	}
+	return c
 }
 
 func SleepWithContext(ctx context.Context, d time.Duration) error {
@@ -227,20 +1163,158 @@ func SleepWithContext(ctx context.Context, d time.Duration) error {
 	}
 }
 
+// versionString describes the build: the version, the commit and the Go version it was built with
+func versionString() string {
+	commit := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("route53-sidecar %s (commit %s, %s)", version, commit, runtime.Version())
+}
+
+// Exit codes of the sidecar, so orchestrators can tell what failed
+const (
+	exitOK       = 0
+	exitRegister = 2 // registering the records failed
+	exitTeardown = 3 // deleting the records failed
+	exitConfig   = 4 // invalid configuration, or the IP address, region or hosted zone could not be resolved
+)
+
+// exitError is an error of run with the exit code it maps to
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitCode logs the error returned by run and returns its exit code
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	log.Error(err)
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitConfig
+}
+
 func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	os.Exit(exitCode(run(context.Background(), os.Args[1:], os.Stdout)))
+}
+
+// forceQuitOn returns a channel that is closed by a SIGTERM or SIGINT received after ctx is done, i.e. after the first one.
+// stop releases the signals of ctx, release stops watching for the signal.
+func forceQuitOn(ctx context.Context, stop context.CancelFunc) (quit <-chan struct{}, release func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(sig)
+		stop() // registered sig first, so no signal falls back to the default action and kills us
+		select {
+		case <-sig:
+			close(closed)
+		case <-done:
+		}
+	}()
+	return closed, func() { close(done) }
+}
+
+// run parses args, without the command name, configures the sidecar and runs the selected mode until it is done or ctx is,
+// a SIGTERM or SIGINT cancels ctx too. The error maps to the exit code with exitCode, -version prints to out.
+func run(ctx context.Context, args []string, out io.Writer) error {
+	// A SIGTERM while fetching the metadata or looking up the zone cancels the requests in flight
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
 	defer stop()
 
-	configureFromFlags(ctx)
-	dumpConfig()
+	if err := parseFlags(args); errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return &exitError{exitConfig, err}
+	}
+	if printVersion { // before any AWS or metadata call, so it works anywhere
+		fmt.Fprintln(out, versionString())
+		return nil
+	}
+
+	rs, err := configureFromFlags(ctx)
+	if errors.Is(err, errTaskStopped) && failOnStopped {
+		return &exitError{exitRegister, fmt.Errorf("skipping registration: %w", err)}
+	} else if errors.Is(err, errTaskStopped) {
+		log.Info("ECS task is being stopped, skipping registration")
+		return nil
+	} else if err != nil && ctx.Err() != nil {
+		log.Infof("Interrupted during startup, nothing registered: %v", err)
+		return nil
+	} else if err != nil {
+		return &exitError{exitConfig, err}
+	}
+	dumpConfig(rs)
+	defer rs.waitWebhooks()
+	if output == outputJSON {
+		for _, r := range rs {
+			r.DryRunOutput = out
+		}
+	}
+
+	if once { // No signal handlers, there is nothing to clean up
+		stop()
+		if err := rs.runOnce(context.WithoutCancel(ctx)); errors.Is(err, errNotLeader) {
+			log.Info("Another task holds the leader lock, nothing registered")
+		} else if err != nil {
+			return &exitError{exitRegister, err}
+		}
+		return nil
+	}
 
 	if register {
-		setupDNS(ctx)
+		if err := rs.Register(ctx); errors.Is(err, errNotLeader) {
+			log.Info("Another task holds the leader lock, nothing registered")
+		} else if err != nil {
+			return &exitError{exitRegister, err}
+		}
 	} else if unRegister {
-		tearDownDNS(ctx)
+		if err := rs.Unregister(ctx); err != nil {
+			return &exitError{exitTeardown, err}
+		}
 	} else { // Setup DNS then teardown when sigterm or sigint is received
-		setupDNS(ctx)
-		<-ctx.Done()                      // Wait for signal, not calling stop() to make sure we don't get killed during clean up
-		tearDownDNS(context.Background()) // Cleanup needs its own context
+		// Not calling stop() to make sure we don't get killed during clean up
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		rs.refreshOn(ctx, hup)
+		quit, release := forceQuitOn(ctx, stop)
+		defer release()
+		for _, r := range rs {
+			r.ForceQuit = quit
+		}
+		if stopPoll > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = stopWhenTaskStopped(ctx, stopPoll)
+			defer cancel()
+		}
+		servers := startServers()
+		err := rs.Run(ctx)
+		stopServers(servers)
+		if errors.Is(err, errNotReady) { // the -readytimeoutaction fail
+			return &exitError{exitRegister, err}
+		} else if err != nil { // Run logs other registration failures and keeps going, only the teardown fails it
+			return &exitError{exitTeardown, err}
+		}
 	}
+	return nil
 }
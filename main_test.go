@@ -1,29 +1,930 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+	"github.com/namsral/flag"
 )
 
-func Test_getEcsMetadata(t *testing.T) {
-	const want = "127.0.0.1"
+// mockRoute53 records every change request and returns wantErrs in order, then succeeds.
+// When records is non-nil the changes are applied to it, keyed by recordKey.
+type mockRoute53 struct {
+	mu               sync.Mutex    // registrars share the mock across zones
+	delay            time.Duration // how long a change takes, to observe overlapping calls
+	inFlight         int
+	maxInFlight      int
+	wantErrs         []error
+	inputs           []*route53.ChangeResourceRecordSetsInput
+	getChangeCalls   int
+	getChangeErrs    []error // returned by GetChange in order, then it succeeds
+	getChangeIDs     []string
+	pending          bool // GetChange never reports INSYNC
+	pendingPolls     int  // GetChange reports PENDING this many times before INSYNC
+	records          map[string]types.ResourceRecordSet
+	hostedZones      []types.HostedZone
+	getHostedZoneErr error
+	privateZoneVPCs  []string // GetHostedZone returns a private zone associated with these VPCs when set
+	hangChanges      int      // the first ChangeResourceRecordSets calls block until their context is done
+	hangGetChanges   int      // the first GetChange calls block until their context is done
+}
+
+// hang blocks until ctx is done while *calls is positive, counting down the calls left to hang
+func (m *mockRoute53) hang(ctx context.Context, calls *int) bool {
+	m.mu.Lock()
+	hang := *calls > 0
+	if hang {
+		*calls--
+	}
+	m.mu.Unlock()
+	if hang {
+		<-ctx.Done()
+	}
+	return hang
+}
+
+func recordKey(rrs *types.ResourceRecordSet) string {
+	return aws.ToString(rrs.Name) + "/" + string(rrs.Type) + "/" + aws.ToString(rrs.SetIdentifier)
+}
+
+func (m *mockRoute53) ChangeResourceRecordSets(ctx context.Context, params *route53.ChangeResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+	if m.hang(ctx, &m.hangChanges) {
+		return nil, ctx.Err()
+	}
+	m.mu.Lock()
+	m.inFlight++
+	m.maxInFlight = max(m.maxInFlight, m.inFlight)
+	m.mu.Unlock()
+	time.Sleep(m.delay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer func() { m.inFlight-- }()
+	m.inputs = append(m.inputs, params)
+	if len(m.wantErrs) > 0 {
+		err := m.wantErrs[0]
+		m.wantErrs = m.wantErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.records != nil {
+		for _, change := range params.ChangeBatch.Changes {
+			key := recordKey(change.ResourceRecordSet)
+			if change.Action == types.ChangeActionDelete {
+				delete(m.records, key)
+			} else {
+				m.records[key] = *change.ResourceRecordSet
+			}
+		}
+	}
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &types.ChangeInfo{Id: aws.String("C123"), Status: types.ChangeStatusPending},
+	}, nil
+}
+
+func (m *mockRoute53) GetChange(ctx context.Context, params *route53.GetChangeInput, optFns ...func(*route53.Options)) (*route53.GetChangeOutput, error) {
+	if m.hang(ctx, &m.hangGetChanges) {
+		return nil, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.getChangeCalls++
+	m.getChangeIDs = append(m.getChangeIDs, aws.ToString(params.Id))
+	if len(m.getChangeErrs) > 0 {
+		err := m.getChangeErrs[0]
+		m.getChangeErrs = m.getChangeErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	status := types.ChangeStatusInsync
+	if m.pending || m.getChangeCalls <= m.pendingPolls {
+		status = types.ChangeStatusPending
+	}
+	return &route53.GetChangeOutput{
+		ChangeInfo: &types.ChangeInfo{Id: params.Id, Status: status},
+	}, nil
+}
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{"Name":"curl","Networks":[{"IPv4Addresses":["` + want + `"]}]}`))
+// GetHostedZone returns getHostedZoneErr, it does not check the zone ID
+func (m *mockRoute53) GetHostedZone(ctx context.Context, params *route53.GetHostedZoneInput, optFns ...func(*route53.Options)) (*route53.GetHostedZoneOutput, error) {
+	if m.getHostedZoneErr != nil {
+		return nil, m.getHostedZoneErr
+	}
+	output := &route53.GetHostedZoneOutput{HostedZone: &types.HostedZone{Id: params.Id}}
+	if m.privateZoneVPCs != nil {
+		output.HostedZone.Config = &types.HostedZoneConfig{PrivateZone: true}
+		for _, vpc := range m.privateZoneVPCs {
+			output.VPCs = append(output.VPCs, types.VPC{VPCId: aws.String(vpc), VPCRegion: types.VPCRegionUsEast1})
+		}
+	}
+	return output, nil
+}
+
+func (m *mockRoute53) ListHostedZonesByName(ctx context.Context, params *route53.ListHostedZonesByNameInput, optFns ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+	return &route53.ListHostedZonesByNameOutput{HostedZones: m.hostedZones}, nil
+}
+
+// ListResourceRecordSets returns the matching records, it fails when the mock does not track records
+func (m *mockRoute53) ListResourceRecordSets(ctx context.Context, params *route53.ListResourceRecordSetsInput, optFns ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.records == nil {
+		return nil, errors.New("records not mocked")
+	}
+	output := &route53.ListResourceRecordSetsOutput{}
+	for _, rrs := range m.records {
+		if sameDomainName(aws.ToString(rrs.Name), aws.ToString(params.StartRecordName)) && (params.StartRecordType == "" || rrs.Type == params.StartRecordType) {
+			output.ResourceRecordSets = append(output.ResourceRecordSets, rrs)
+		}
+	}
+	return output, nil
+}
+
+func init() {
+	resetFlags()
+}
+
+// setTestDefaults keeps the metadata tests fast, it also undoes defineFlags resetting the globals
+func setTestDefaults() {
+	retryBaseDelay = time.Millisecond
+	imdsTimeout = time.Second
+	ecsTimeout = time.Second
+}
+
+// resetFlags sets every flag global back to its default, and the globals configureFromFlags derives from them,
+// so no test depends on the flags of the tests that ran before it
+func resetFlags() {
+	saved := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("route53-sidecar", flag.ContinueOnError)
+	defineFlags()
+	flag.CommandLine = saved
+	taskARN, geoLocation = "", nil
+	setTestDefaults()
+}
+
+// resetFlagsAfter restores flag.CommandLine and resets every flag global when the test ends
+func resetFlagsAfter(t *testing.T) {
+	savedFlags := flag.CommandLine
+	t.Cleanup(func() {
+		flag.CommandLine = savedFlags
+		resetFlags()
 	})
-	server := httptest.NewServer(handler)
+}
+
+// withMockRoute53 makes run() use mock and outside of ECS, until the test ends and every flag global is reset
+func withMockRoute53(t *testing.T, mock route53API) {
+	t.Helper()
+	resetFlagsAfter(t)
+	savedClient := newRoute53Client
+	t.Cleanup(func() { newRoute53Client = savedClient })
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", "")
+	newRoute53Client = func(aws.Config) route53API { return mock }
+}
+
+// runWithMock runs the sidecar with args against mock, discarding its stdout
+func runWithMock(t *testing.T, mock route53API, args ...string) error {
+	t.Helper()
+	withMockRoute53(t, mock)
+	return run(context.Background(), args, io.Discard)
+}
+
+func Test_splitList(t *testing.T) {
+	got := splitList(" ZPUBLIC, ,ZPRIVATE ")
+	if strings.Join(got, "|") != "ZPUBLIC|ZPRIVATE" {
+		t.Errorf("splitList() = %q", got)
+	}
+	if got := splitList(""); len(got) != 0 {
+		t.Errorf("splitList(\"\") = %q, want none", got)
+	}
+}
+
+func Test_resolveRecordType(t *testing.T) {
+	tests := []struct {
+		recordType string
+		ip         string
+		want       types.RRType
+		wantErr    bool
+	}{
+		{"auto", "10.0.0.1", types.RRTypeA, false},
+		{"auto", "2001:db8::1", types.RRTypeAaaa, false},
+		{"A", "10.0.0.1", types.RRTypeA, false},
+		{"aaaa", "2001:db8::1", types.RRTypeAaaa, false},
+		{"AAAA", "10.0.0.1", "", true},
+		{"A", "2001:db8::1", "", true},
+		{"A", "not-an-ip", "", true},
+		{"MX", "10.0.0.1", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveRecordType(tt.recordType, tt.ip)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveRecordType(%q, %q) error = %v, wantErr %v", tt.recordType, tt.ip, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveRecordType(%q, %q) = %v, want %v", tt.recordType, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func Test_validateRoutingPolicy(t *testing.T) {
+	for _, policy := range []string{routingSimple, routingWeighted, routingMultiValue} {
+		if err := validateRoutingPolicy(policy); err != nil {
+			t.Errorf("validateRoutingPolicy(%q) error = %v", policy, err)
+		}
+	}
+	if err := validateRoutingPolicy("roundrobin"); err == nil {
+		t.Error("validateRoutingPolicy(\"roundrobin\") error = nil, want error")
+	}
+}
+
+func Test_lookupHostedZone(t *testing.T) {
+	zone := func(id, name string, private bool) types.HostedZone {
+		return types.HostedZone{
+			Id:     aws.String("/hostedzone/" + id),
+			Name:   aws.String(name),
+			Config: &types.HostedZoneConfig{PrivateZone: private},
+		}
+	}
+	mock := &mockRoute53{hostedZones: []types.HostedZone{
+		zone("ZPUBLIC", "example.com.", false),
+		zone("ZPRIVATE", "example.com.", true),
+		zone("ZOTHER", "example.com.au.", false),
+	}}
+
+	tests := []struct {
+		name    string
+		private bool
+		want    string
+		wantErr bool
+	}{
+		{"example.com.", false, "ZPUBLIC", false},
+		{"example.com", true, "ZPRIVATE", false},
+		{"example.com.au.", true, "ZOTHER", false},
+		{"example.org.", false, "", true},
+	}
+	for _, tt := range tests {
+		got, err := lookupHostedZone(context.Background(), mock, tt.name, tt.private)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("lookupHostedZone(%q, %v) error = %v, wantErr %v", tt.name, tt.private, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("lookupHostedZone(%q, %v) = %v, want %v", tt.name, tt.private, got, tt.want)
+		}
+	}
+}
+
+func Test_checkHostedZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{"exists", nil, ""},
+		{"not found", &types.NoSuchHostedZone{Message: aws.String("No hosted zone found with ID: Z123")}, "hosted zone Z123 does not exist"},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized"}, "grant route53:GetHostedZone"},
+		{"other", errors.New("connection reset"), "unable to check hosted zone Z123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHostedZone(context.Background(), &mockRoute53{getHostedZoneErr: tt.err}, "Z123")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkHostedZone() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.Is(err, tt.err) {
+				t.Errorf("checkHostedZone() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkZoneVPC(t *testing.T) {
+	tests := []struct {
+		name    string
+		vpcs    []string
+		wantErr bool
+	}{
+		{"public", nil, false},
+		{"associated", []string{"vpc-other", "vpc-task"}, false},
+		{"not associated", []string{"vpc-other"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkZoneVPC(context.Background(), &mockRoute53{privateZoneVPCs: tt.vpcs}, "Z123", "vpc-task")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkZoneVPC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_runVPCCheck(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		check   string
+		want    int
+		changes int
+	}{
+		{checkWarn, exitOK, 1},
+		{checkFail, exitConfig, 0},
+	} {
+		t.Run(tt.check, func(t *testing.T) {
+			buf.Reset()
+			mock := &mockRoute53{privateZoneVPCs: []string{"vpc-other"}}
+			args := []string{"-register", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-syncpollinterval=1ms",
+				"-vpccheck=" + tt.check, "-vpcid=vpc-task"}
+
+			if got := exitCode(runWithMock(t, mock, args...)); got != tt.want {
+				t.Errorf("exitCode(run()) = %d, want %d", got, tt.want)
+			}
+			if len(mock.inputs) != tt.changes {
+				t.Errorf("ChangeResourceRecordSets called %d times, want %d", len(mock.inputs), tt.changes)
+			}
+			if got := buf.String(); !strings.Contains(got, "not associated with VPC vpc-task") {
+				t.Errorf("output %q, want the zone VPCs explained", got)
+			}
+			if tt.check == checkWarn && !strings.Contains(buf.String(), "WARN") {
+				t.Errorf("output %q, want a warning", buf.String())
+			}
+		})
+	}
+}
+
+func Test_runIdentifierCheck(t *testing.T) {
+	sibling := types.ResourceRecordSet{Name: aws.String("my.example.com"), Type: types.RRTypeA, SetIdentifier: aws.String("blue"),
+		ResourceRecords: []types.ResourceRecord{{Value: aws.String("10.0.0.2")}}}
+	for _, tt := range []struct {
+		check   string
+		want    int
+		changes int
+	}{
+		{checkOff, exitOK, 1},
+		{checkWarn, exitOK, 1},
+		{checkFail, exitConfig, 0},
+	} {
+		t.Run(tt.check, func(t *testing.T) {
+			mock := &mockRoute53{records: map[string]types.ResourceRecordSet{recordKey(&sibling): sibling}}
+			args := []string{"-register", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-syncpollinterval=1ms",
+				"-setidentifier=blue", "-identifiercheck=" + tt.check}
+
+			if got := exitCode(runWithMock(t, mock, args...)); got != tt.want {
+				t.Errorf("exitCode(run()) = %d, want %d", got, tt.want)
+			}
+			if len(mock.inputs) != tt.changes {
+				t.Errorf("ChangeResourceRecordSets called %d times, want %d", len(mock.inputs), tt.changes)
+			}
+		})
+	}
+}
+
+func Test_quoteTXT(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"v1.2.3", `"v1.2.3"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{strings.Repeat("a", 256), `"` + strings.Repeat("a", 255) + `" "a"`},
+	}
+	for _, tt := range tests {
+		if got := quoteTXT(tt.value); got != tt.want {
+			t.Errorf("quoteTXT(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_sameDomainName(t *testing.T) {
+	if !sameDomainName("My.Example.com.", "my.example.com") {
+		t.Error("sameDomainName() = false for case and trailing dot differences")
+	}
+	if !sameDomainName(`\052.example.com.`, "*.example.com") {
+		t.Error("sameDomainName() = false for the escaped wildcard")
+	}
+	if sameDomainName("api.example.com", "example.com") {
+		t.Error("sameDomainName() = true for different names")
+	}
+}
+
+func Test_resolveAliasRecordType(t *testing.T) {
+	for rt, want := range map[string]types.RRType{"auto": types.RRTypeA, "A": types.RRTypeA, "aaaa": types.RRTypeAaaa} {
+		if got, err := resolveAliasRecordType(rt); err != nil || got != want {
+			t.Errorf("resolveAliasRecordType(%q) = %v, %v, want %v", rt, got, err, want)
+		}
+	}
+	if _, err := resolveAliasRecordType("CNAME"); err == nil {
+		t.Error("resolveAliasRecordType(\"CNAME\") error = nil, want error")
+	}
+}
+
+func Test_parseGeoLocation(t *testing.T) {
+	tests := []struct {
+		geo       string
+		continent string
+		country   string
+		sub       string
+		wantErr   bool
+	}{
+		{"continent=eu", "EU", "", "", false},
+		{"country=US", "", "US", "", false},
+		{"country=US, subdivision=CA", "", "US", "CA", false},
+		{"*", "", "*", "", false},
+		{"", "", "", "", true},
+		{"US", "", "", "", true},
+		{"planet=earth", "", "", "", true},
+		{"continent=EU,country=FR", "", "", "", true},
+		{"subdivision=CA", "", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseGeoLocation(tt.geo)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGeoLocation(%q) error = %v, wantErr %v", tt.geo, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if aws.ToString(got.ContinentCode) != tt.continent || aws.ToString(got.CountryCode) != tt.country || aws.ToString(got.SubdivisionCode) != tt.sub {
+			t.Errorf("parseGeoLocation(%q) = %+v, want %s/%s/%s", tt.geo, *got, tt.continent, tt.country, tt.sub)
+		}
+	}
+}
+
+func Test_srvValue(t *testing.T) {
+	if got := srvValue(10, 5, 8080, "host.example.com"); got != "10 5 8080 host.example.com." {
+		t.Errorf("srvValue() = %q", got)
+	}
+	if got := srvValue(0, 0, 443, "host.example.com."); got != "0 0 443 host.example.com." {
+		t.Errorf("srvValue() with a trailing dot = %q", got)
+	}
+}
+
+func Test_runExitCodes(t *testing.T) {
+	denied := errors.New("AccessDenied")
+	tests := []struct {
+		name     string
+		args     []string
+		wantErrs []error
+		zoneErr  error
+		want     int
+	}{
+		{"registered", []string{"-register"}, nil, nil, exitOK},
+		{"registration failed", []string{"-register"}, []error{denied}, nil, exitRegister},
+		{"teardown failed", []string{"-unregister", "-skipttlwait"}, []error{denied}, nil, exitTeardown},
+		{"invalid config", []string{"-register", "-dnsttl=-1"}, nil, nil, exitConfig},
+		{"missing zone", []string{"-register"}, nil, &types.NoSuchHostedZone{}, exitConfig},
+		{"zone check skipped", []string{"-register", "-skipzonecheck"}, nil, &types.NoSuchHostedZone{}, exitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockRoute53{wantErrs: tt.wantErrs, getHostedZoneErr: tt.zoneErr}
+			args := append([]string{"-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-retrybasedelay=1ms", "-syncpollinterval=1ms"}, tt.args...)
+
+			if got := exitCode(runWithMock(t, mock, args...)); got != tt.want {
+				t.Errorf("exitCode(run()) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runQuiet(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(levelInfo)
+	}()
+
+	for _, tt := range []struct {
+		name      string
+		args      []string
+		wantInfo  bool
+		wantError bool
+		want      int
+	}{
+		{"default", nil, true, false, exitOK},
+		{"quiet", []string{"-quiet"}, false, false, exitOK},
+		{"quiet with error", []string{"-quiet", "-loglevel=debug"}, false, true, exitRegister},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			mock := &mockRoute53{}
+			if tt.wantError {
+				mock.wantErrs = []error{errors.New("AccessDenied")}
+			}
+			args := append([]string{"-register", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-retrybasedelay=1ms", "-syncpollinterval=1ms"}, tt.args...)
+
+			if got := exitCode(runWithMock(t, mock, args...)); got != tt.want {
+				t.Errorf("exitCode(run()) = %d, want %d", got, tt.want)
+			}
+			got := buf.String()
+			if strings.Contains(got, "INFO") != tt.wantInfo {
+				t.Errorf("output %q, want INFO lines %v", got, tt.wantInfo)
+			}
+			if strings.Contains(got, "ERROR") != tt.wantError {
+				t.Errorf("output %q, want ERROR lines %v", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func Test_runMultipleIPs(t *testing.T) {
+	mock := &mockRoute53{}
+	args := []string{"-register", "-hostedzone=Z123", "-ipaddress=10.0.0.1,10.0.1.1,10.0.2.1", "-region=us-east-1", "-syncpollinterval=1ms"}
+
+	if got := exitCode(runWithMock(t, mock, args...)); got != exitOK {
+		t.Fatalf("exitCode(run()) = %d, want %d", got, exitOK)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if got := mock.inputs[0].ChangeBatch.Changes[0].ResourceRecordSet.ResourceRecords; len(got) != 3 {
+		t.Errorf("got %d ResourceRecords, want the 3 addresses", len(got))
+	}
+}
+
+func Test_runRegister(t *testing.T) {
+	args := []string{"-register", "-dns=api.example.com", "-dnsttl=30", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1",
+		"-retrybasedelay=1ms", "-syncpollinterval=1ms"}
+
+	mock := &mockRoute53{}
+	if err := runWithMock(t, mock, args...); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	input := mock.inputs[0]
+	if got := aws.ToString(input.HostedZoneId); got != "Z123" {
+		t.Errorf("HostedZoneId = %v, want Z123", got)
+	}
+	if len(input.ChangeBatch.Changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(input.ChangeBatch.Changes))
+	}
+	change := input.ChangeBatch.Changes[0]
+	rrs := change.ResourceRecordSet
+	if change.Action != types.ChangeActionUpsert || aws.ToString(rrs.Name) != "api.example.com" || rrs.Type != types.RRTypeA ||
+		aws.ToInt64(rrs.TTL) != 30 || aws.ToString(rrs.ResourceRecords[0].Value) != "10.0.0.1" {
+		t.Errorf("got %s %s %s TTL %d => %s, want UPSERT api.example.com A TTL 30 => 10.0.0.1",
+			change.Action, aws.ToString(rrs.Name), rrs.Type, aws.ToInt64(rrs.TTL), aws.ToString(rrs.ResourceRecords[0].Value))
+	}
+	if mock.getChangeCalls == 0 {
+		t.Error("GetChange not called, want run to wait for the change to be INSYNC")
+	}
+
+	denied := errors.New("AccessDenied")
+	err := runWithMock(t, &mockRoute53{wantErrs: []error{denied}}, args...)
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != exitRegister || !errors.Is(err, denied) {
+		t.Errorf("run() error = %v, want exit code %d wrapping %v", err, exitRegister, denied)
+	}
+}
+
+func Test_taskID(t *testing.T) {
+	tests := []struct {
+		arn     string
+		want    string
+		wantErr bool
+	}{
+		{"arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c", "158d1c8083dd49d6b527399fd6414f5c", false},
+		{"arn:aws:ecs:us-west-2:111122223333:task/158d1c8083dd49d6b527399fd6414f5c", "158d1c8083dd49d6b527399fd6414f5c", false},
+		{"arn:aws:ecs:us-west-2:111122223333:container-instance/default/abc", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := taskID(tt.arn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("taskID(%q) error = %v, wantErr %v", tt.arn, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("taskID(%q) = %v, want %v", tt.arn, got, tt.want)
+		}
+	}
+}
+
+func Test_runTaskSetIdentifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"TaskARN":"arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c","DesiredStatus":"RUNNING","Containers":[{"Name":"app"}]}`))
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"default", nil, "10.0.0.1"},
+		{"ecs-task", []string{"-setidentifier=ecs-task"}, "158d1c8083dd49d6b527399fd6414f5c"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockRoute53{}
+			withMockRoute53(t, mock)
+			t.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+			args := append([]string{"-register", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-syncpollinterval=1ms"}, tt.args...)
+
+			if got := exitCode(run(context.Background(), args, io.Discard)); got != exitOK {
+				t.Fatalf("exitCode(run()) = %d, want %d", got, exitOK)
+			}
+			if len(mock.inputs) != 1 {
+				t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+			}
+			if got := aws.ToString(mock.inputs[0].ChangeBatch.Changes[0].ResourceRecordSet.SetIdentifier); got != tt.want {
+				t.Errorf("SetIdentifier = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runDryRunJSON(t *testing.T) {
+	mock := &mockRoute53{}
+	withMockRoute53(t, mock)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var stdout bytes.Buffer
+	args := []string{"-register", "-dryrun", "-output=json", "-dns=api.example.com", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1"}
+	if err := run(context.Background(), args, &stdout); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times on a dry run", len(mock.inputs))
+	}
+
+	// The shape of aws route53 change-resource-record-sets --cli-input-json
+	var input struct {
+		HostedZoneId string
+		ChangeBatch  struct {
+			Changes []struct {
+				Action            string
+				ResourceRecordSet map[string]any
+			}
+			Comment string
+		}
+	}
+	decoder := json.NewDecoder(&stdout)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&input); err != nil {
+		t.Fatalf("stdout is not a change batch: %v", err)
+	}
+	if input.HostedZoneId != "Z123" || len(input.ChangeBatch.Changes) != 1 || input.ChangeBatch.Changes[0].Action != "UPSERT" {
+		t.Fatalf("stdout = %+v, want one UPSERT in Z123", input)
+	}
+	rrs := input.ChangeBatch.Changes[0].ResourceRecordSet
+	if rrs["Name"] != "api.example.com" || rrs["Type"] != "A" {
+		t.Errorf("ResourceRecordSet = %v, want the A record of api.example.com", rrs)
+	}
+	for key, value := range rrs {
+		if value == nil || value == "" {
+			t.Errorf("ResourceRecordSet[%s] = %#v, want unset fields left out", key, value)
+		}
+	}
+	if strings.Contains(logs.String(), `"HostedZoneId"`) {
+		t.Errorf("the change was also logged: %s", logs.String())
+	}
+}
+
+func Test_runDryRunJSONLongRunning(t *testing.T) {
+	mock := &mockRoute53{}
+	withMockRoute53(t, mock)
+
+	// The upsert and the teardown would be two change batches on stdout
+	var stdout bytes.Buffer
+	args := []string{"-dryrun", "-output=json", "-dns=api.example.com", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1"}
+	if got := exitCode(run(context.Background(), args, &stdout)); got != exitConfig {
+		t.Errorf("exitCode(run()) = %d, want %d", got, exitConfig)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("stdout = %q, want nothing written", stdout.String())
+	}
+}
+
+func Test_runDryRunJSONConfigFile(t *testing.T) {
+	mock := &mockRoute53{}
+	withMockRoute53(t, mock)
+
+	// -output is only checked against -dryrun once the file is loaded
+	path := filepath.Join(t.TempDir(), "sidecar.yaml")
+	if err := os.WriteFile(path, []byte("output: JSON\ndryrun: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	args := []string{"-register", "-config=" + path, "-dns=api.example.com", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1"}
+	if err := run(context.Background(), args, &stdout); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times on a dry run", len(mock.inputs))
+	}
+	var input route53.ChangeResourceRecordSetsInput
+	if err := json.Unmarshal(stdout.Bytes(), &input); err != nil || aws.ToString(input.HostedZoneId) != "Z123" {
+		t.Errorf("stdout = %q, want the change batch of Z123: %v", stdout.String(), err)
+	}
+}
+
+func Test_runTargetHostname(t *testing.T) {
+	hostname := "ip-10-0-0-1.ec2.internal"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Name":"app","Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["10.0.0.1"],"PrivateDNSName":"` + hostname + `"}]}]}`))
+	}))
 	defer server.Close()
+	mock := &mockRoute53{}
+	withMockRoute53(t, mock)
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+	args := []string{"-register", "-hostedzone=Z123", "-recordtype=CNAME", "-target=hostname", "-region=us-east-1", "-syncpollinterval=1ms"}
+
+	if err := run(context.Background(), args, io.Discard); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	rrs := mock.inputs[0].ChangeBatch.Changes[0].ResourceRecordSet
+	if rrs.Type != types.RRTypeCname || aws.ToString(rrs.ResourceRecords[0].Value) != hostname {
+		t.Errorf("got %s => %s, want CNAME => %s", rrs.Type, aws.ToString(rrs.ResourceRecords[0].Value), hostname)
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"DesiredStatus":"RUNNING","Containers":[{"Name":"app","Networks":[{"NetworkMode":"awsvpc","PrivateDNSName":"ip-10-0-0-1"}]}]}`))
+	})
+	if err := run(context.Background(), args, io.Discard); err == nil || !strings.Contains(err.Error(), "-target") {
+		t.Errorf("run() error = %v, want an unqualified host name rejected", err)
+	}
+}
 
-	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+func Test_forceQuitOn(t *testing.T) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	quit, release := forceQuitOn(ctx, stop)
+	defer release()
 
-	got, err := getEcsMetadata()
+	self, err := os.FindProcess(os.Getpid())
 	if err != nil {
-		t.Errorf("getEcsMetadata() error = %v", err)
-		return
+		t.Fatal(err)
+	}
+	self.Signal(os.Interrupt)
+	<-ctx.Done()
+	select {
+	case <-quit:
+		t.Fatal("quit closed by the first signal")
+	default:
+	}
+
+	// Until forceQuitOn took over from ctx the signals are still handled by ctx
+	deadline := time.After(5 * time.Second)
+	for {
+		self.Signal(os.Interrupt)
+		select {
+		case <-quit:
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("quit not closed by the second signal")
+		}
+	}
+}
+
+func Test_dnsTTLs(t *testing.T) {
+	defer func(s string) { dns = s }(dns)
+	dns = "failover.example.com=5, cached.example.com"
+
+	if got := strings.Join(dnsNames(), ","); got != "failover.example.com,cached.example.com" {
+		t.Errorf("dnsNames() = %q", got)
+	}
+	ttls, err := dnsTTLs()
+	if err != nil || len(ttls) != 1 || ttls["failover.example.com"] != 5 {
+		t.Errorf("dnsTTLs() = %v, %v, want failover.example.com=5", ttls, err)
+	}
+
+	dns = "failover.example.com=short"
+	if _, err := dnsTTLs(); err == nil {
+		t.Error("dnsTTLs() error = nil, want error for a non-numeric TTL")
+	}
+}
+
+func Test_cpuWeight(t *testing.T) {
+	tests := []struct {
+		perCPU  int64
+		vcpus   float64
+		want    int64
+		wantErr bool
+	}{
+		{100, 0.25, 25, false},
+		{100, 2, 200, false},
+		{100, 4, maxWeight, false},
+		{1, 0.25, 1, false},
+		{100, 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := cpuWeight(tt.perCPU, tt.vcpus)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("cpuWeight(%d, %v) = %d, %v, want %d", tt.perCPU, tt.vcpus, got, err, tt.want)
+		}
+	}
+}
+
+func Test_runVersion(t *testing.T) {
+	var buf strings.Builder
+	withMockRoute53(t, nil)
+	newRoute53Client = func(aws.Config) route53API {
+		t.Error("-version created a Route53 client")
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"-version"}, &buf); err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "route53-sidecar "+version+" (commit ") || !strings.Contains(got, runtime.Version()) {
+		t.Errorf("version output = %q", got)
+	}
+}
+
+func Test_reverseName(t *testing.T) {
+	tests := []struct {
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{"1.2.3.4", "4.3.2.1.in-addr.arpa.", false},
+		{"10.0.0.254", "254.0.0.10.in-addr.arpa.", false},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", false},
+		{"not-an-ip", "", true},
+	}
+	for _, tt := range tests {
+		got, err := reverseName(tt.ip)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("reverseName(%q) = %q, %v, want %q", tt.ip, got, err, tt.want)
+		}
+	}
+}
+
+func Test_dnsNamesDomainSuffix(t *testing.T) {
+	defer func(s, suffix string) { dns, domainSuffix = s, suffix }(dns, domainSuffix)
+	dns, domainSuffix = "api=5,www.example.org", "example.com."
+
+	if got := strings.Join(dnsNames(), ","); got != "api.example.com.,www.example.org" {
+		t.Errorf("dnsNames() = %q, want api qualified and www.example.org as given", got)
+	}
+	if ttls, err := dnsTTLs(); err != nil || ttls["api.example.com."] != 5 {
+		t.Errorf("dnsTTLs() = %v, %v, want the TTL of the qualified name", ttls, err)
+	}
+	if got := qualifyName("api", ".example.com"); got != "api.example.com" {
+		t.Errorf("qualifyName() = %q", got)
+	}
+}
+
+func Test_punycodeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"bücher.example.com":        "xn--bcher-kva.example.com",
+		"API.Bücher.example.com.":   "API.xn--bcher-kva.example.com.",
+		"*.münchen.de":              "*.xn--mnchen-3ya.de",
+		"_sip._tcp.example.com":     "_sip._tcp.example.com",
+		"xn--bcher-kva.example.com": "xn--bcher-kva.example.com",
+	} {
+		if got := punycodeName(name); got != want {
+			t.Errorf("punycodeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func Test_runPunycode(t *testing.T) {
+	mock := &mockRoute53{}
+	args := []string{"-register", "-dns=bücher.example.com=30", "-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-syncpollinterval=1ms"}
+
+	if err := runWithMock(t, mock, args...); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
 	}
-	if got.Networks[0].IPv4Addresses[0] != want {
-		t.Errorf("getEcsMetadata() = %v, want %v", got, want)
+	rrs := mock.inputs[0].ChangeBatch.Changes[0].ResourceRecordSet
+	if got := aws.ToString(rrs.Name); got != "xn--bcher-kva.example.com" || aws.ToInt64(rrs.TTL) != 30 {
+		t.Errorf("got %s TTL %d, want xn--bcher-kva.example.com with its TTL 30", got, aws.ToInt64(rrs.TTL))
 	}
 }
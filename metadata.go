@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// imdsAPI is the subset of the EC2 instance metadata client used by the sidecar
+type imdsAPI interface {
+	GetMetadata(ctx context.Context, params *imds.GetMetadataInput, optFns ...func(*imds.Options)) (*imds.GetMetadataOutput, error)
+}
+
+// imdsAddressPaths maps the -ipaddress sentinels to their EC2 instance metadata path
+var imdsAddressPaths = map[string]string{
+	"public-ipv4":  "public-ipv4",
+	"private-ipv4": "local-ipv4",
+	"local-ipv4":   "local-ipv4",
+}
+
+// imdsPath returns the instance metadata path of an -ipaddress sentinel or imds:<path> value
+func imdsPath(ipAddress string) (string, bool) {
+	if path, ok := strings.CutPrefix(ipAddress, "imds:"); ok {
+		return strings.Trim(path, "/"), true
+	}
+	path, ok := imdsAddressPaths[ipAddress]
+	return path, ok
+}
+
+// newImdsClient returns an instance metadata client which always uses IMDSv2 tokens when available,
+// falling back to IMDSv1 only if the token request fails
+func newImdsClient(cfg aws.Config) *imds.Client {
+	return imds.NewFromConfig(cfg, func(o *imds.Options) {
+		o.ClientEnableState = imds.ClientEnabled
+		o.EnableFallback = aws.TrueTernary
+		// getImdsValue retries, so an unreachable IMDS fails with its connection error rather than the timeout of the SDK retries
+		o.Retryer = aws.NopRetryer{}
+	})
+}
+
+// getImdsAddress fetches an IP address from the given instance metadata path
+func getImdsAddress(ctx context.Context, client imdsAPI, path string) (string, error) {
+	value, err := getImdsValue(ctx, client, path, "-ipaddress")
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(value) == nil {
+		return "", fmt.Errorf("instance metadata %q is not an IP address: %q", path, value)
+	}
+	return value, nil
+}
+
+// getImdsValue fetches the given instance metadata path without surrounding whitespace,
+// flagName is suggested as the alternative when IMDS is unreachable
+func getImdsValue(ctx context.Context, client imdsAPI, path, flagName string) (string, error) {
+	if path == "" {
+		return "", errors.New("empty instance metadata path")
+	}
+	var value []byte
+	err := retryWithBackoff(ctx, metadataRetries, retryBaseDelay, isRetryableMetadataError, func() (err error) {
+		value, err = fetchImdsValue(ctx, client, path)
+		return err
+	})
+	if isUnreachable(err) {
+		return "", fmt.Errorf("unable to connect to the instance metadata service for %q, this does not look like an EC2 instance; "+
+			"pass an explicit %s (e.g. when testing locally) or run on EC2: %w", path, flagName, err)
+	} else if isTimeout(err) {
+		return "", fmt.Errorf("timed out after %v fetching instance metadata %q, IMDS may be disabled or its hop limit too low for containers, or this is not an EC2 instance; "+
+			"enable IMDS (with a hop limit of 2) or pass an explicit %s: %w", imdsTimeout, path, flagName, err)
+	} else if isHTTPStatus(err, http.StatusNotFound) {
+		return "", fmt.Errorf("instance metadata path %q does not exist, see the instance metadata categories in the EC2 documentation: %w", path, err)
+	} else if err != nil {
+		return "", err
+	}
+	trimmed := strings.TrimSpace(string(value))
+	if trimmed == "" {
+		return "", fmt.Errorf("instance metadata %q is empty", path)
+	}
+	return trimmed, nil
+}
+
+// fetchImdsValue makes a single instance metadata request, bounded by the -imdstimeout
+func fetchImdsValue(ctx context.Context, client imdsAPI, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, imdsTimeout)
+	defer cancel()
+
+	output, err := client.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Content.Close()
+	return io.ReadAll(output.Content)
+}
+
+// isRetryableMetadataError retries every metadata error except a cancelled context or a missing path,
+// the endpoints are often slow at container start
+func isRetryableMetadataError(err error) bool {
+	return !errors.Is(err, context.Canceled) && !isHTTPStatus(err, http.StatusNotFound)
+}
+
+// isHTTPStatus reports whether err is an AWS SDK response error with the given HTTP status code
+func isHTTPStatus(err error, code int) bool {
+	var statusErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &statusErr) && statusErr.HTTPStatusCode() == code
+}
+
+type ecsMetadata struct {
+	TaskARN       string       `json:"-"` // only in the task metadata
+	CPU           float64      `json:"-"` // vCPUs of the task, only in the task metadata when set
+	DesiredStatus string       `json:"DesiredStatus"`
+	Networks      []ecsNetwork `json:"Networks"`
+}
+
+type ecsNetwork struct {
+	NetworkMode    string   `json:"NetworkMode"`
+	IPv4Addresses  []string `json:"IPv4Addresses"`
+	IPv6Addresses  []string `json:"IPv6Addresses"`
+	PrivateDNSName string   `json:"PrivateDNSName"` // of the ENI, awsvpc networks only
+}
+
+// ecsTaskMetadata is the response of the v4 /task endpoint, listing every container of the task
+type ecsTaskMetadata struct {
+	TaskARN       string `json:"TaskARN"`
+	DesiredStatus string `json:"DesiredStatus"`
+	Limits        struct {
+		CPU float64 `json:"CPU"` // vCPUs
+	} `json:"Limits"`
+	Containers []struct {
+		Name     string       `json:"Name"`
+		Networks []ecsNetwork `json:"Networks"`
+	} `json:"Containers"`
+}
+
+// errTaskStopped is returned when the ECS task is already being stopped, there is nothing to register
+var errTaskStopped = errors.New("ECS task is being stopped")
+
+// getEcsAddress fetches the ECS network metadata and selects the task address
+func getEcsAddress(ctx context.Context, ipv6 bool, cidr *net.IPNet) (string, error) {
+	metadata, err := getEcsNetworkMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	if metadata.DesiredStatus == "STOPPED" {
+		return "", errTaskStopped
+	}
+	return metadata.selectAddress(ipv6, cidr)
+}
+
+// getEcsHostname fetches the ECS network metadata and returns the private DNS name of the first network that has one
+func getEcsHostname(ctx context.Context) (string, error) {
+	metadata, err := getEcsNetworkMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, network := range metadata.Networks {
+		if network.PrivateDNSName != "" {
+			return network.PrivateDNSName, nil
+		}
+	}
+	return "", errors.New("no private DNS name found in ECS metadata, it is only set for awsvpc networks")
+}
+
+// getEcsNetworkMetadata fetches the ECS task metadata, or the container metadata if that fails. The container metadata
+// is that of the sidecar itself, so there is no fallback when a -container is selected.
+func getEcsNetworkMetadata(ctx context.Context) (*ecsMetadata, error) {
+	metadata, err := getEcsTaskMetadata(ctx)
+	if err != nil && container == "" {
+		log.Debugf("Falling back to the ECS container metadata: %v", err)
+		return getEcsMetadata(ctx)
+	}
+	return metadata, err
+}
+
+// stopWhenTaskStopped returns a context that is cancelled with ctx, or once the ECS task metadata polled every
+// interval shows the task is being stopped, so teardown starts before the SIGTERM arrives
+func stopWhenTaskStopped(ctx context.Context, interval time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			metadata, err := getEcsTaskMetadata(ctx)
+			if err != nil {
+				log.Debugf("Unable to poll the ECS task status: %v", err)
+				continue
+			}
+			if metadata.DesiredStatus == "STOPPED" {
+				log.Info("ECS task is being stopped, tearing down before the SIGTERM")
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// selectAddress returns the first IPv4 (or IPv6) address in the task networks, restricted to cidr when it is not nil
+func (m *ecsMetadata) selectAddress(ipv6 bool, cidr *net.IPNet) (string, error) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	for _, network := range m.Networks {
+		addresses := network.IPv4Addresses
+		if ipv6 {
+			addresses = network.IPv6Addresses
+		}
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				continue
+			}
+			if cidr == nil || cidr.Contains(ip) {
+				return address, nil
+			}
+		}
+	}
+	if cidr != nil {
+		return "", fmt.Errorf("no %s address in %v found in ECS metadata", family, cidr)
+	}
+	if ipv6 {
+		return "", errors.New("no IPv6 address found in ECS metadata, AAAA records need a task in a dual-stack subnet")
+	}
+	return "", fmt.Errorf("no %s address found in ECS metadata", family)
+}
+
+func getEcsMetadata(ctx context.Context) (*ecsMetadata, error) {
+	// Get metadata URI from ECS_CONTAINER_METADATA_URI_V4 or ECS_CONTAINER_METADATA_URI
+	uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if uri == "" {
+		uri = os.Getenv("ECS_CONTAINER_METADATA_URI")
+	}
+	metadata := &ecsMetadata{}
+	if err := fetchEcsMetadata(ctx, uri, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// getEcsTaskMetadata fetches the v4 /task metadata, listing the awsvpc networks of its containers first,
+// or only the networks of the -container when one is selected
+func getEcsTaskMetadata(ctx context.Context) (*ecsMetadata, error) {
+	uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if uri == "" {
+		return nil, errors.New("ECS_CONTAINER_METADATA_URI_V4 is not set")
+	}
+	task := &ecsTaskMetadata{}
+	if err := fetchEcsMetadata(ctx, strings.TrimSuffix(uri, "/")+"/task", task); err != nil {
+		return nil, err
+	}
+	if len(task.Containers) == 0 {
+		return nil, errors.New("no containers in ECS task metadata")
+	}
+
+	metadata := &ecsMetadata{TaskARN: task.TaskARN, CPU: task.Limits.CPU, DesiredStatus: task.DesiredStatus}
+	var other []ecsNetwork
+	var names []string
+	for _, c := range task.Containers {
+		names = append(names, c.Name)
+		if container != "" && c.Name != container {
+			continue
+		}
+		for _, network := range c.Networks {
+			if network.NetworkMode == "awsvpc" {
+				metadata.Networks = append(metadata.Networks, network)
+			} else {
+				other = append(other, network)
+			}
+		}
+	}
+	metadata.Networks = append(metadata.Networks, other...)
+	if container != "" && !slices.Contains(names, container) {
+		return nil, fmt.Errorf("no container named %q in the ECS task metadata, the task has %s", container, strings.Join(names, ", "))
+	}
+	return metadata, nil
+}
+
+// fetchEcsMetadata decodes the ECS metadata at uri into v, retrying failed requests until ctx is done
+func fetchEcsMetadata(ctx context.Context, uri string, v any) error {
+	client := http.Client{
+		Timeout: ecsTimeout,
+	}
+	return retryWithBackoff(ctx, metadataRetries, retryBaseDelay, isRetryableMetadataError, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("ECS metadata returned %s", resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+}
+
+// isUnreachable reports whether err is a connection refused or a missing route, as outside of EC2
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
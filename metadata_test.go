@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// mockImds serves the metadata values keyed by path and records the requested paths, unknown paths are a 404.
+// When hang is set it blocks until the context is done like an unreachable IMDS endpoint
+type mockImds struct {
+	values map[string]string
+	paths  []string
+	hang   bool
+}
+
+func (m *mockImds) GetMetadata(ctx context.Context, params *imds.GetMetadataInput, optFns ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
+	m.paths = append(m.paths, params.Path)
+	if m.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	value, ok := m.values[params.Path]
+	if !ok {
+		return nil, &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotFound}},
+			Err:      errors.New("request to EC2 IMDS failed"),
+		}
+	}
+	return &imds.GetMetadataOutput{Content: io.NopCloser(strings.NewReader(value))}, nil
+}
+
+func Test_getEcsMetadata(t *testing.T) {
+	const want = "127.0.0.1"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Name":"curl","Networks":[{"IPv4Addresses":["` + want + `"]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	got, err := getEcsMetadata(context.Background())
+	if err != nil {
+		t.Errorf("getEcsMetadata() error = %v", err)
+		return
+	}
+	if got.Networks[0].IPv4Addresses[0] != want {
+		t.Errorf("getEcsMetadata() = %v, want %v", got, want)
+	}
+}
+
+func Test_getEcsMetadataRetries(t *testing.T) {
+	defer func(n int) { metadataRetries = n }(metadataRetries)
+	metadataRetries = 3
+
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests <= 2 {
+			http.Error(w, "not ready", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"Networks":[{"IPv4Addresses":["10.0.0.1"]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	got, err := getEcsMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("getEcsMetadata() error = %v", err)
+	}
+	if ip := got.Networks[0].IPv4Addresses[0]; ip != "10.0.0.1" {
+		t.Errorf("getEcsMetadata() address = %v, want 10.0.0.1", ip)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+
+	metadataRetries = 1
+	requests = 0
+	if _, err := getEcsMetadata(context.Background()); err == nil {
+		t.Error("getEcsMetadata() error = nil, want error after exhausting the retries")
+	}
+}
+
+func Test_getEcsMetadataIPv6(t *testing.T) {
+	const want = "2001:db8::1"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Name":"curl","Networks":[{"IPv4Addresses":["127.0.0.1"],"IPv6Addresses":["` + want + `"]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	got, err := getEcsMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("getEcsMetadata() error = %v", err)
+	}
+	if ip, err := got.selectAddress(true, nil); err != nil || ip != want {
+		t.Errorf("selectAddress(true, nil) = %v, %v, want %v", ip, err, want)
+	}
+	if ip, err := got.selectAddress(false, nil); err != nil || ip != "127.0.0.1" {
+		t.Errorf("selectAddress(false, nil) = %v, %v, want %v", ip, err, "127.0.0.1")
+	}
+}
+
+func Test_getImdsAddress(t *testing.T) {
+	client := &mockImds{values: map[string]string{
+		"public-ipv4": "54.1.2.3",
+		"local-ipv4":  "10.0.0.1",
+		"network/interfaces/macs/0e:9e:32:c7:48:85/local-ipv4s": "10.0.1.7",
+		"ipv6": "",
+	}}
+
+	tests := []struct {
+		ipAddress string
+		want      string
+		wantErr   bool
+	}{
+		{"public-ipv4", "54.1.2.3", false},
+		{"private-ipv4", "10.0.0.1", false},
+		{"local-ipv4", "10.0.0.1", false},
+		{"imds:local-ipv4", "10.0.0.1", false},
+		{"imds:/network/interfaces/macs/0e:9e:32:c7:48:85/local-ipv4s", "10.0.1.7", false},
+		{"imds:no-such-category", "", true},
+	}
+	for _, tt := range tests {
+		path, ok := imdsPath(tt.ipAddress)
+		if !ok {
+			t.Fatalf("imdsPath(%q) not found", tt.ipAddress)
+		}
+		got, err := getImdsAddress(context.Background(), client, path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("getImdsAddress(%q) error = %v, wantErr %v", path, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("getImdsAddress(%q) = %v, want %v", path, got, tt.want)
+		}
+	}
+
+	if _, err := getImdsAddress(context.Background(), client, "ipv6"); err == nil {
+		t.Error("getImdsAddress(\"ipv6\") error = nil, want error for empty metadata")
+	}
+}
+
+func Test_getImdsAddressTimeout(t *testing.T) {
+	defer func(d time.Duration) { imdsTimeout = d }(imdsTimeout)
+	imdsTimeout = 10 * time.Millisecond
+
+	_, err := getImdsAddress(context.Background(), &mockImds{hang: true}, "public-ipv4")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("getImdsAddress() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !strings.Contains(err.Error(), "-ipaddress") {
+		t.Errorf("getImdsAddress() error = %q, want a hint to pass -ipaddress", err)
+	}
+}
+
+func Test_getImdsAddressUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "http://" + listener.Addr().String()
+	listener.Close() // nothing listens there anymore, like IMDS outside of EC2
+
+	client := imds.New(imds.Options{Endpoint: endpoint, Retryer: aws.NopRetryer{}})
+	_, err = getImdsAddress(context.Background(), client, "public-ipv4")
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("getImdsAddress() error = %v, want %v", err, syscall.ECONNREFUSED)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "does not look like an EC2 instance") || !strings.Contains(msg, "pass an explicit -ipaddress") {
+		t.Errorf("getImdsAddress() error = %q, want a hint to pass -ipaddress or run on EC2", msg)
+	}
+}
+
+func Test_selectAddress(t *testing.T) {
+	var empty, multi ecsMetadata
+	if err := json.Unmarshal([]byte(`{"Networks":[]}`), &empty); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"Networks":[
+		{"IPv4Addresses":[]},
+		{"IPv4Addresses":["169.254.172.2"]},
+		{"IPv4Addresses":["10.0.1.5","10.0.2.7"]}
+	]}`), &multi); err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.0.2.0/24")
+	_, missing, _ := net.ParseCIDR("192.168.0.0/16")
+
+	tests := []struct {
+		name     string
+		metadata *ecsMetadata
+		ipv6     bool
+		cidr     *net.IPNet
+		want     string
+		wantErr  bool
+	}{
+		{"empty networks", &empty, false, nil, "", true},
+		{"first non-empty network", &multi, false, nil, "169.254.172.2", false},
+		{"preferred cidr", &multi, false, subnet, "10.0.2.7", false},
+		{"cidr not found", &multi, false, missing, "", true},
+		{"no ipv6", &multi, true, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.metadata.selectAddress(tt.ipv6, tt.cidr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getEcsAddressStopped(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"DesiredStatus":"STOPPED","Networks":[{"IPv4Addresses":["10.0.0.1"]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	if _, err := getEcsAddress(context.Background(), false, nil); !errors.Is(err, errTaskStopped) {
+		t.Errorf("getEcsAddress() error = %v, want %v", err, errTaskStopped)
+	}
+}
+
+func Test_getEcsAddressTaskMetadata(t *testing.T) {
+	const task = `{
+		"Cluster": "default",
+		"TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+		"DesiredStatus": "RUNNING",
+		"KnownStatus": "RUNNING",
+		"Containers": [
+			{
+				"Name": "route53-sidecar",
+				"Networks": [{"NetworkMode": "bridge", "IPv4Addresses": ["172.17.0.3"]}]
+			},
+			{
+				"Name": "app",
+				"Networks": [{
+					"NetworkMode": "awsvpc",
+					"IPv4Addresses": ["10.0.2.106"],
+					"AttachmentIndex": 0,
+					"MACAddress": "0e:9e:32:c7:48:85",
+					"IPv4SubnetCIDRBlock": "10.0.2.0/24",
+					"PrivateDNSName": "ip-10-0-2-106.us-west-2.compute.internal"
+				}]
+			}
+		]
+	}`
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/task" {
+			w.Write([]byte(`{"Networks":[{"IPv4Addresses":["172.17.0.3"]}]}`))
+			return
+		}
+		w.Write([]byte(task))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	got, err := getEcsAddress(context.Background(), false, nil)
+	if err != nil {
+		t.Fatalf("getEcsAddress() error = %v", err)
+	}
+	if got != "10.0.2.106" {
+		t.Errorf("getEcsAddress() = %v, want the awsvpc address 10.0.2.106", got)
+	}
+}
+
+func Test_getEcsAddressContainerFallback(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/task" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"Networks":[{"IPv4Addresses":["10.0.0.1"]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	if got, err := getEcsAddress(context.Background(), false, nil); err != nil || got != "10.0.0.1" {
+		t.Errorf("getEcsAddress() = %v, %v, want 10.0.0.1 from the container metadata", got, err)
+	}
+}
+
+func Test_getEcsAddressContainer(t *testing.T) {
+	defer func() { container = "" }()
+	const task = `{
+		"DesiredStatus": "RUNNING",
+		"Containers": [
+			{"Name": "route53-sidecar", "Networks": [{"NetworkMode": "bridge", "IPv4Addresses": ["172.17.0.3"]}]},
+			{"Name": "envoy", "Networks": [{"NetworkMode": "bridge", "IPv4Addresses": ["172.17.0.4"]}]},
+			{"Name": "app", "Networks": [{"NetworkMode": "bridge", "IPv4Addresses": ["172.17.0.5"]}]}
+		]
+	}`
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/task" {
+			w.Write([]byte(`{"Networks":[{"IPv4Addresses":["172.17.0.3"]}]}`))
+			return
+		}
+		w.Write([]byte(task))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	for name, want := range map[string]string{"": "172.17.0.3", "app": "172.17.0.5", "envoy": "172.17.0.4"} {
+		container = name
+		if got, err := getEcsAddress(context.Background(), false, nil); err != nil || got != want {
+			t.Errorf("getEcsAddress() with -container %q = %v, %v, want %v", name, got, err, want)
+		}
+	}
+
+	container = "worker"
+	_, err := getEcsAddress(context.Background(), false, nil)
+	if err == nil || !strings.Contains(err.Error(), `no container named "worker"`) || !strings.Contains(err.Error(), "app") {
+		t.Errorf("getEcsAddress() error = %v, want the missing container named along with those of the task", err)
+	}
+}
+
+func Test_getImdsAddressNotFound(t *testing.T) {
+	defer func(n int) { metadataRetries = n }(metadataRetries)
+	metadataRetries = 3
+
+	client := &mockImds{}
+	_, err := getImdsAddress(context.Background(), client, "no-such-category")
+	if err == nil || !strings.Contains(err.Error(), `"no-such-category" does not exist`) {
+		t.Errorf("getImdsAddress() error = %v, want a clear error for the missing path", err)
+	}
+	if len(client.paths) != 1 {
+		t.Errorf("got %d requests, want 1, a missing path is not retried", len(client.paths))
+	}
+	if _, ok := imdsPath("ecs"); ok {
+		t.Error(`imdsPath("ecs") ok = true, want false`)
+	}
+}
+
+func Test_getImdsAddressWhitespace(t *testing.T) {
+	client := &mockImds{values: map[string]string{
+		"public-ipv4": "54.1.2.3\n",
+		"mac":         "0e:9e:32:c7:48:85",
+	}}
+	got, err := getImdsAddress(context.Background(), client, "public-ipv4")
+	if err != nil {
+		t.Fatalf("getImdsAddress() error = %v", err)
+	}
+	if got != "54.1.2.3" {
+		t.Errorf("getImdsAddress() = %q, want %q", got, "54.1.2.3")
+	}
+	if _, err := getImdsAddress(context.Background(), client, "mac"); err == nil {
+		t.Error(`getImdsAddress("mac") error = nil, want error for a value that is not an IP address`)
+	}
+}
+
+func Test_getEcsMetadataCancelled(t *testing.T) {
+	defer func(timeout time.Duration) { ecsTimeout = timeout }(ecsTimeout)
+	ecsTimeout = 10 * time.Second
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done() // the agent never answers
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := getEcsMetadata(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getEcsMetadata() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("getEcsMetadata() returned after %v, want it cancelled promptly", elapsed)
+	}
+}
+
+func Test_getEcsTaskMetadataCPUWeight(t *testing.T) {
+	const task = `{
+		"TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+		"DesiredStatus": "RUNNING",
+		"Limits": {"CPU": 0.5, "Memory": 1024},
+		"Containers": [{"Name": "app", "Networks": [{"NetworkMode": "awsvpc", "IPv4Addresses": ["10.0.2.106"]}]}]
+	}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(task))
+	}))
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	metadata, err := getEcsTaskMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("getEcsTaskMetadata() error = %v", err)
+	}
+	if metadata.CPU != 0.5 {
+		t.Errorf("CPU = %v, want 0.5", metadata.CPU)
+	}
+	if got, err := cpuWeight(100, metadata.CPU); err != nil || got != 50 {
+		t.Errorf("cpuWeight(100, %v) = %d, %v, want 50", metadata.CPU, got, err)
+	}
+}
+
+func Test_stopWhenTaskStopped(t *testing.T) {
+	var polls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := "RUNNING"
+		if polls.Add(1) > 2 {
+			status = "STOPPED"
+		}
+		w.Write([]byte(`{"DesiredStatus":"` + status + `","Containers":[{"Name":"app","Networks":[{"NetworkMode":"awsvpc","IPv4Addresses":["10.0.0.1"]}]}]}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx, stop := stopWhenTaskStopped(ctx, 5*time.Millisecond)
+	defer stop()
+
+	mock := &mockRoute53{}
+	if err := testRegistrar(mock).Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Fatalf("context error = %v, want it cancelled by the STOPPED status", ctx.Err())
+	}
+	if len(mock.inputs) != 2 || mock.inputs[1].ChangeBatch.Changes[0].Action != types.ChangeActionDelete {
+		t.Errorf("got %d change batches, want the registration and the teardown", len(mock.inputs))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	registrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "route53_sidecar_registrations_total",
+		Help: "Number of DNS registrations by result.",
+	}, []string{"result"})
+
+	deregistrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "route53_sidecar_deregistrations_total",
+		Help: "Number of DNS deregistrations by result.",
+	}, []string{"result"})
+
+	syncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "route53_sidecar_sync_duration_seconds",
+		Help:    "Time spent waiting for Route53 changes to become INSYNC.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 7), // 5s to 320s
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(registrationsTotal, deregistrationsTotal, syncDuration)
+}
+
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// resultLabel maps an operation error to the "result" label value
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric returns the value of the first sample matching the given series, or 0 if absent
+func scrapeMetric(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d", rec.Code)
+	}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid sample %q: %v", scanner.Text(), err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func Test_metricsRegistration(t *testing.T) {
+	const success = `route53_sidecar_registrations_total{result="success"}`
+	const syncCount = `route53_sidecar_sync_duration_seconds_count`
+	before := scrapeMetric(t, success)
+	beforeSync := scrapeMetric(t, syncCount)
+
+	if err := testRegistrar(&mockRoute53{}).Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	if got := scrapeMetric(t, success); got != before+1 {
+		t.Errorf("%s = %v, want %v", success, got, before+1)
+	}
+	if got := scrapeMetric(t, syncCount); got != beforeSync+1 {
+		t.Errorf("%s = %v, want %v", syncCount, got, beforeSync+1)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// portPollInterval is how often waitForPort dials the application
+var portPollInterval = 500 * time.Millisecond
+
+// portAddress turns a -waitforport value into a dial address, a bare port means localhost
+func portAddress(port string) string {
+	if port != "" && !strings.Contains(port, ":") {
+		return net.JoinHostPort("localhost", port)
+	}
+	return port
+}
+
+// waitForPort dials address until it accepts a TCP connection, ctx is done or timeout (if positive) expires
+func waitForPort(ctx context.Context, address string, timeout time.Duration) error {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		log.Debugf("Application not accepting connections on %s yet: %v", address, err)
+		if err := SleepWithContext(ctx, portPollInterval); err != nil {
+			if parent.Err() == nil {
+				return fmt.Errorf("application not accepting connections on %s after %v", address, timeout)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_portAddress(t *testing.T) {
+	for port, want := range map[string]string{"8080": "localhost:8080", "app:8080": "app:8080", "[::1]:80": "[::1]:80"} {
+		if got := portAddress(port); got != want {
+			t.Errorf("portAddress(%q) = %q, want %q", port, got, want)
+		}
+	}
+}
+
+func Test_waitForPort(t *testing.T) {
+	defer func(interval time.Duration) { portPollInterval = interval }(portPollInterval)
+	portPollInterval = 5 * time.Millisecond
+
+	// Reserve a free port, then let the "application" listen on it a little later
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	opened := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- l
+	}()
+
+	start := time.Now()
+	if err := waitForPort(context.Background(), address, time.Second); err != nil {
+		t.Fatalf("waitForPort() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("waitForPort() returned after %v, before the port was opened", elapsed)
+	}
+	if l := <-opened; l != nil {
+		l.Close()
+	}
+}
+
+func Test_waitForPortTimeout(t *testing.T) {
+	defer func(interval time.Duration) { portPollInterval = interval }(portPollInterval)
+	portPollInterval = 5 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	err = waitForPort(context.Background(), address, 20*time.Millisecond)
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waitForPort() error = %v, want a timeout naming the address", err)
+	}
+}
+
+func Test_RegisterReadyTimeout(t *testing.T) {
+	defer func(interval time.Duration) { portPollInterval = interval }(portPollInterval)
+	portPollInterval = 5 * time.Millisecond
+
+	// The application never listens, so only the -readytimeout ends the wait
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	for _, tt := range []struct {
+		name        string
+		register    bool
+		wantChanges int
+	}{
+		{"fail", false, 0},
+		{"register", true, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockRoute53{}
+			r := testRegistrar(mock)
+			r.SetupDelay = 10 * time.Millisecond
+			r.WaitForPort = address
+			r.ReadyTimeout = 50 * time.Millisecond
+			r.RegisterUnready = tt.register
+
+			start := time.Now()
+			err := r.Register(context.Background())
+			if elapsed := time.Since(start); elapsed < r.ReadyTimeout || elapsed > time.Second {
+				t.Errorf("Register() returned after %v, want about the -readytimeout of %v", elapsed, r.ReadyTimeout)
+			}
+			if tt.register && err != nil {
+				t.Errorf("Register() error = %v, want the records registered anyway", err)
+			} else if !tt.register && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Register() error = %v, want the -readytimeout exceeded", err)
+			}
+			if errors.Is(err, errSetupInterrupted) {
+				t.Errorf("Register() error = %v, the deadline is not an interruption", err)
+			}
+			if len(mock.inputs) != tt.wantChanges {
+				t.Errorf("ChangeResourceRecordSets called %d times, want %d", len(mock.inputs), tt.wantChanges)
+			}
+		})
+	}
+}
+
+func Test_RunReadyTimeout(t *testing.T) {
+	defer func(interval time.Duration) { portPollInterval = interval }(portPollInterval)
+	portPollInterval = 5 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	// Run fails right away instead of waiting for a signal to tear down records it never registered
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.WaitForPort = address
+	r.ReadyTimeout = 50 * time.Millisecond
+	if err := r.Run(context.Background()); !errors.Is(err, errNotReady) {
+		t.Errorf("Run() error = %v, want %v", err, errNotReady)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want no upsert or teardown", len(mock.inputs))
+	}
+
+	args := []string{"-hostedzone=Z123", "-ipaddress=10.0.0.1", "-region=us-east-1", "-waitforport=" + address, "-readytimeout=50ms"}
+	if got := exitCode(runWithMock(t, mock, args...)); got != exitRegister {
+		t.Errorf("exitCode(run()) = %d, want %d", got, exitRegister)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want none", len(mock.inputs))
+	}
+}
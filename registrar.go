@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// Registrar registers the DNS records of a task in a hosted zone and removes them again on shutdown
+type Registrar struct {
+	API          route53API
+	Names        []string
+	HostedZone   string
+	TTL          int
+	TTLs         map[string]int // per name overrides of TTL
+	MinTTL       int            // TTLs below it are raised to it
+	RejectLowTTL bool           // fail validate instead of raising TTLs below MinTTL
+	RecordType   types.RRType
+
+	IPAddress                       string                                    // A and AAAA records
+	ResolveIP                       func(ctx context.Context) (string, error) // re-resolves IPAddress on refresh, nil when it is fixed
+	IPSource                        IPSource                                  // where IPAddress came from, nil for a target or an alias
+	ExtraIPAddresses                []string                                  // more values of the A or AAAA record after IPAddress, resolved once at startup
+	IPv6Address                     string                                    // dual-stack: the value of an AAAA record next to the A record, resolved once at startup
+	Target                          string                                    // CNAME and SRV records
+	AliasTarget, AliasZone          string
+	EvaluateTargetHealth            bool
+	SRVPriority, SRVWeight, SRVPort int
+	TXTValue                        string
+	Comment                         string
+	StateFile                       string // records the pending change, so a restart resumes waiting for it
+	Webhook                         string // receives a POST after every successful registration and teardown
+
+	RoutingPolicy string
+	SetIdentifier string
+	Weight        int64
+	Region        string
+	GeoLocation   *types.GeoLocation
+
+	DeleteStale          bool   // delete records left behind by earlier tasks when registering
+	OverwriteConflicting bool   // delete existing records of another type that Route53 does not allow next to ours
+	SkipUnchanged        bool   // do not upsert records that already exist as they are
+	SplitInvalidBatch    bool   // submit the changes one by one when Route53 rejects the batch, so the valid records still get applied
+	DeleteFetched        bool   // tear down the records with the TTL, weight and values found in the zone rather than the configured ones
+	Locker               Locker // only register while holding this leader lock, nil to always register
+
+	DryRun             bool
+	DryRunOutput       io.Writer // receives the change batches of a dry run as JSON instead of the log, e.g. stdout
+	Wait               bool      // wait for registrations to be INSYNC, teardown waits unless FastTeardown
+	SkipTTLWait        bool
+	WaitRemainingTTL   bool // teardown only waits what remains of the TTL since the last upsert, instead of the full TTL
+	FastTeardown       bool // return as soon as the delete is submitted, without waiting for INSYNC or the TTL
+	NoTeardown         bool // Run leaves the records in place when ctx is done, e.g. for a blue/green handoff
+	SetupDelay         time.Duration
+	StartupJitter      time.Duration // wait a random duration up to this before registering, to spread the calls of tasks started together
+	WaitForPort        string        // only register once the application accepts connections on this address
+	WaitForPortTimeout time.Duration
+	ReadyTimeout       time.Duration // bounds the setup delay, jitter and port wait together, 0 for none
+	RegisterUnready    bool          // register anyway once the ReadyTimeout expires, instead of failing
+	RefreshInterval    time.Duration
+	RefreshTrigger     <-chan struct{} // re-register on demand, e.g. on SIGHUP
+	ForceQuit          <-chan struct{} // closed to abort the teardown of Run, e.g. on a second SIGTERM
+	MaxRetries         int
+	RetryBaseDelay     time.Duration
+	SyncPollInterval   time.Duration
+	SyncPollMax        time.Duration // doubles the poll interval up to this after every poll, fixed unless above SyncPollInterval
+	SyncTimeout        time.Duration
+	SyncMaxFailures    int           // throttled GetChange calls tolerated while waiting for INSYNC
+	APITimeout         time.Duration // bounds each Route53 call, 0 for none
+
+	mu         sync.Mutex     // one change, and its wait for INSYNC, in flight at a time
+	upsertedAt time.Time      // last upsert of the records, WaitRemainingTTL only waits what remains of the TTL since
+	leader     bool           // holds the lock of Locker
+	webhooks   sync.WaitGroup // pending webhook notifications
+}
+
+// registrars registers the same records in several hosted zones, e.g. split-horizon public and private zones.
+// Every zone is handled concurrently so the setup delay and TTL wait are not multiplied.
+type registrars []*Registrar
+
+func (rs registrars) Register(ctx context.Context) error {
+	return rs.each(func(r *Registrar) error { return r.Register(ctx) })
+}
+
+func (rs registrars) Unregister(ctx context.Context) error {
+	return rs.each(func(r *Registrar) error { return r.Unregister(ctx) })
+}
+
+func (rs registrars) Run(ctx context.Context) error {
+	return rs.each(func(r *Registrar) error { return r.Run(ctx) })
+}
+
+func (rs registrars) runOnce(ctx context.Context) error {
+	return rs.each(func(r *Registrar) error { return r.runOnce(ctx) })
+}
+
+// refreshOn makes every registrar re-register whenever trigger fires, until ctx is done
+func (rs registrars) refreshOn(ctx context.Context, trigger <-chan os.Signal) {
+	var triggers []chan struct{}
+	for _, r := range rs {
+		ch := make(chan struct{}, 1)
+		r.RefreshTrigger = ch
+		triggers = append(triggers, ch)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+				for _, ch := range triggers {
+					select {
+					case ch <- struct{}{}:
+					default: // a refresh is already pending
+					}
+				}
+			}
+		}
+	}()
+}
+
+// each calls fn for every registrar concurrently and joins their errors
+func (rs registrars) each(fn func(r *Registrar) error) error {
+	errs := make([]error, len(rs))
+	var wg sync.WaitGroup
+	for i, r := range rs {
+		wg.Add(1)
+		go func(i int, r *Registrar) {
+			defer wg.Done()
+			errs[i] = fn(r)
+		}(i, r)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// errSetupInterrupted is returned when the context is cancelled before anything was registered
+var errSetupInterrupted = errors.New("interrupted before registering DNS")
+
+// errNotReady is returned when the application is not ready within the ReadyTimeout and RegisterUnready is not set
+var errNotReady = errors.New("application not ready")
+
+// Register waits for a change left pending by a previous run, the setup delay and the application's port,
+// then registers the DNS records
+func (r *Registrar) Register(ctx context.Context) error {
+	if err := r.resumePending(ctx); ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", errSetupInterrupted, ctx.Err())
+	} else if err != nil {
+		r.logger().Warnf("Unable to resume the change of the previous run: %v", err)
+	}
+	ready := ctx
+	if r.ReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		ready, cancel = context.WithTimeout(ctx, r.ReadyTimeout)
+		defer cancel()
+	}
+	if err := r.waitReady(ready); ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", errSetupInterrupted, ctx.Err())
+	} else if ready.Err() != nil && r.RegisterUnready {
+		r.logger().Warnf("Application not ready after %v, registering DNS anyway", r.ReadyTimeout)
+	} else if ready.Err() != nil {
+		return fmt.Errorf("%w after the -readytimeout of %v, not registering DNS: %w", errNotReady, r.ReadyTimeout, ready.Err())
+	} else if err != nil {
+		return err
+	}
+	if leader, err := r.acquireLeadership(ctx); err != nil {
+		return err
+	} else if !leader {
+		return errNotLeader
+	}
+	return r.upsert(ctx)
+}
+
+// waitReady waits for the setup delay, the startup jitter and the application's port, until ctx is done
+func (r *Registrar) waitReady(ctx context.Context) error {
+	if r.SetupDelay > 0 {
+		log.Infof("Waiting %v before setting up DNS", r.SetupDelay)
+		if err := SleepWithContext(ctx, r.SetupDelay); err != nil {
+			return err
+		}
+	}
+	if r.StartupJitter > 0 {
+		delay := jitter(r.StartupJitter)
+		log.Infof("Waiting a random %v before setting up DNS", delay)
+		if err := SleepWithContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+	if r.WaitForPort != "" {
+		log.Infof("Waiting for the application to accept connections on %s", r.WaitForPort)
+		return waitForPort(ctx, r.WaitForPort, r.WaitForPortTimeout)
+	}
+	return nil
+}
+
+// acquireLeadership takes or renews the leader lock and reports whether this task may own the records,
+// always true without a Locker or on a dry run
+func (r *Registrar) acquireLeadership(ctx context.Context) (bool, error) {
+	if r.Locker == nil || r.DryRun {
+		return true, nil
+	}
+	leader, err := r.Locker.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire the leader lock: %w", err)
+	}
+	if r.leader && !leader {
+		r.logger().Warn("Lost the leader lock to another task, no longer refreshing the DNS records")
+	} else if !r.leader && leader {
+		r.logger().Info("Acquired the leader lock")
+	}
+	r.leader = leader
+	return leader, nil
+}
+
+// Run registers the DNS records, keeps them refreshed until ctx is done and then tears them down
+func (r *Registrar) Run(ctx context.Context) error {
+	err := r.Register(ctx)
+	if errors.Is(err, errSetupInterrupted) {
+		log.Info("Interrupted during setup delay, nothing to tear down")
+		return nil
+	} else if errors.Is(err, errNotLeader) {
+		log.Info("Another task holds the leader lock, standing by")
+	} else if errors.Is(err, errNotReady) {
+		return err // nothing was registered, the sidecar fails instead of running without records
+	} else if err != nil {
+		log.Error(err)
+	}
+	r.refresh(ctx)
+
+	if r.NoTeardown {
+		registered.Store(false)
+		log.Info("Keeping the DNS records for the next task to take over, not tearing them down")
+		return nil
+	}
+	// Cleanup needs its own context, only a second signal aborts it
+	teardownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if r.ForceQuit != nil {
+		go func() {
+			select {
+			case <-r.ForceQuit:
+				log.Warn("Received another signal, aborting the teardown")
+				cancel()
+			case <-teardownCtx.Done():
+			}
+		}()
+	}
+	return r.Unregister(teardownCtx)
+}
+
+// runOnce registers the DNS records and returns, nothing is torn down afterwards
+func (r *Registrar) runOnce(ctx context.Context) error {
+	if err := r.Register(ctx); err != nil {
+		return err
+	}
+	log.Info("Registered DNS, exiting without teardown")
+	return nil
+}
+
+// Unregister deletes the DNS records and waits for the TTL to expire so clients stop using them
+func (r *Registrar) Unregister(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { deregistrationsTotal.WithLabelValues(resultLabel(err)).Inc() }()
+
+	l := r.logger()
+	if r.Locker != nil && !r.DryRun {
+		// Only the leader owns the records, another task may share our names and SetIdentifier
+		if leader, err := r.acquireLeadership(ctx); err != nil {
+			return err
+		} else if !leader {
+			l.Info("Another task holds the leader lock, nothing to tear down")
+			return nil
+		}
+		defer func() {
+			if err := r.Locker.Release(context.WithoutCancel(ctx)); err != nil {
+				l.Warnf("Failed to release the leader lock: %v", err)
+			}
+		}()
+	}
+	if err := r.resumePending(ctx); err != nil && ctx.Err() == nil {
+		l.Warnf("Unable to resume the change of the previous run: %v", err)
+	}
+	l.Infof("Tearing down Route 53 DNS Name %s %s => %s", r.RecordType, strings.Join(r.Names, ","), r.recordValue())
+	registered.Store(false)
+	input := &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &types.ChangeBatch{
+			Changes: r.changes(types.ChangeActionDelete),
+			Comment: aws.String(r.Comment),
+		},
+		HostedZoneId: aws.String(r.HostedZone),
+	}
+	if r.DryRun {
+		return logDryRun(input, r.DryRunOutput)
+	}
+
+	// Only delete what is still there, a single missing record would fail the whole batch
+	existing, err := r.existingChanges(ctx, input.ChangeBatch.Changes)
+	if err != nil {
+		l.Warnf("Unable to list the existing records, deleting all of them: %v", err)
+	} else if len(existing) == 0 {
+		l.Info("DNS records already deleted, nothing to tear down")
+		return nil
+	} else {
+		input.ChangeBatch.Changes = existing
+	}
+
+	changeSet, err := r.changeResourceRecordSets(ctx, input)
+	if isNotFoundError(err) {
+		l.Infof("DNS records already deleted, nothing to tear down: %v", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to delete DNS: %w", err)
+	}
+
+	l.With("changeId", aws.ToString(changeSet.ChangeInfo.Id)).Info("Request sent to Route 53...")
+	defer r.webhooks.Wait() // do not exit before the deregistration was posted, it is bounded by webhookTimeout
+	if r.FastTeardown {
+		r.notify("deregister", aws.ToString(changeSet.ChangeInfo.Id))
+		l.Info("Fast teardown, not waiting for the delete to propagate or the DNS Timeout")
+		return nil
+	}
+	if err := r.waitForSync(ctx, changeSet); err != nil {
+		return err
+	}
+	r.notify("deregister", aws.ToString(changeSet.ChangeInfo.Id))
+
+	if r.SkipTTLWait {
+		l.Info("Skipping the DNS Timeout wait")
+		return nil
+	}
+
+	// Then wait the DNS Timeout to expire, the deleted records may have had a longer TTL than configured now
+	ttl := r.maxTTL()
+	for _, change := range input.ChangeBatch.Changes {
+		ttl = max(ttl, int(aws.ToInt64(change.ResourceRecordSet.TTL)))
+	}
+	wait := time.Duration(ttl) * time.Second
+	if r.WaitRemainingTTL && !r.upsertedAt.IsZero() {
+		// Resolvers that answered since the last upsert may still cache the records for up to the full TTL
+		elapsed := time.Since(r.upsertedAt)
+		if elapsed >= wait {
+			l.Infof("Last upserted %v ago, more than the DNS Timeout (%d seconds), not waiting for resolvers that cached the records since", elapsed.Round(time.Second), ttl)
+			return nil
+		}
+		wait -= elapsed
+	}
+	l.Infof("Waiting for DNS Timeout to expire (%v of %d seconds)", wait.Round(time.Millisecond), ttl)
+	if err := SleepWithContext(ctx, wait); err != nil {
+		// The records are already deleted, only the drain was cut short
+		l.Warnf("DNS Timeout wait interrupted, clients that cached the records may still connect to this task: %v", err)
+		return nil
+	}
+	l.Info("DNS Timeout expiry finished")
+	return nil
+}
+
+func (r *Registrar) upsert(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { registrationsTotal.WithLabelValues(resultLabel(err)).Inc() }()
+
+	l := r.logger()
+	l.Infof("Setting up Route 53 DNS Name %s %s => %s", r.RecordType, strings.Join(r.Names, ","), r.recordValue())
+
+	upserts := r.changes(types.ChangeActionUpsert)
+	input := &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &types.ChangeBatch{
+			Changes: upserts,
+			Comment: aws.String(r.Comment),
+		},
+		HostedZoneId: aws.String(r.HostedZone),
+	}
+	if r.DeleteStale {
+		// Deleted in the same batch, so the name never resolves to fewer records than before
+		stale, err := r.staleChanges(ctx)
+		if err != nil {
+			l.Warnf("Unable to list the records to find stale ones, not deleting any: %v", err)
+		} else if len(stale) > 0 {
+			l.Infof("Deleting %d stale records left behind by earlier tasks", len(stale))
+			input.ChangeBatch.Changes = append(input.ChangeBatch.Changes, stale...)
+		}
+	}
+	if r.SkipUnchanged && len(input.ChangeBatch.Changes) == len(upserts) {
+		if unchanged, err := r.unchanged(ctx, upserts); err != nil {
+			l.Warnf("Unable to list the existing records, upserting them: %v", err)
+		} else if unchanged {
+			l.Info("DNS records are already up to date, nothing to change")
+			registered.Store(true)
+			return nil
+		}
+	}
+	if r.DryRun {
+		return logDryRun(input, r.DryRunOutput)
+	}
+
+	changeSet, err := r.changeResourceRecordSets(ctx, input)
+	if isConflictError(err) && r.OverwriteConflicting {
+		l.Warnf("Replacing the existing records that conflict with ours: %v", err)
+		conflicting, listErr := r.conflictingChanges(ctx, conflictingType(err))
+		if listErr != nil {
+			return fmt.Errorf("failed to find the conflicting DNS records: %w", listErr)
+		}
+		// Deleted in the same batch as our upsert, so the name never stops resolving in between
+		replace := *input
+		replace.ChangeBatch = &types.ChangeBatch{Changes: append(conflicting, input.ChangeBatch.Changes...), Comment: input.ChangeBatch.Comment}
+		// A failed replace is not split, the changes one by one would fail on the conflict again
+		if changeSet, err = r.changeResourceRecordSets(ctx, &replace); isConflictError(err) {
+			return r.conflictError(err)
+		} else if err != nil {
+			return fmt.Errorf("failed to replace the conflicting DNS records: %w", err)
+		}
+	}
+	if r.SplitInvalidBatch && isInvalidBatchError(err) && len(input.ChangeBatch.Changes) > 1 {
+		l.Warnf("Route53 rejected the batch, submitting the %d changes one by one: %v", len(input.ChangeBatch.Changes), err)
+		return r.upsertIndividually(ctx, input)
+	}
+	if isConflictError(err) {
+		return r.conflictError(err)
+	} else if err != nil {
+		return fmt.Errorf("failed to create DNS: %w", err)
+	}
+
+	l = l.With("changeId", aws.ToString(changeSet.ChangeInfo.Id))
+	l.Info("Request sent to Route 53...")
+	if !r.Wait {
+		l.Info("Not waiting for Route 53 to propagate the change")
+	} else if err := r.waitForSync(ctx, changeSet); err != nil {
+		return err
+	}
+	r.markRegistered()
+	r.notify("register", aws.ToString(changeSet.ChangeInfo.Id))
+	return nil
+}
+
+// markRegistered reports the sidecar as registered after an upsert and records when it was sent, r.mu must be held
+func (r *Registrar) markRegistered() {
+	registered.Store(true)
+	r.upsertedAt = time.Now()
+}
+
+// upsertIndividually submits every change of input in a batch of its own, so one invalid record does not keep the others from being applied.
+// It fails when any of the changes fails, after the others are applied.
+func (r *Registrar) upsertIndividually(ctx context.Context, input *route53.ChangeResourceRecordSetsInput) error {
+	l := r.logger()
+	var changeSets []*route53.ChangeResourceRecordSetsOutput
+	var errs []error
+	for _, change := range input.ChangeBatch.Changes {
+		rrs := change.ResourceRecordSet
+		changeSet, err := r.changeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+			ChangeBatch:  &types.ChangeBatch{Changes: []types.Change{change}, Comment: input.ChangeBatch.Comment},
+			HostedZoneId: input.HostedZoneId,
+		})
+		if err != nil {
+			l.Errorf("Route53 rejected the %s of %s %s: %v", change.Action, rrs.Type, aws.ToString(rrs.Name), err)
+			errs = append(errs, fmt.Errorf("%s %s: %w", rrs.Type, aws.ToString(rrs.Name), err))
+			continue
+		}
+		changeSets = append(changeSets, changeSet)
+	}
+	for _, changeSet := range changeSets {
+		l.With("changeId", aws.ToString(changeSet.ChangeInfo.Id)).Info("Request sent to Route 53...")
+		if r.Wait {
+			if err := r.waitForSync(ctx, changeSet); err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to create %d of %d DNS records: %w", len(errs), len(input.ChangeBatch.Changes), errors.Join(errs...))
+	}
+	r.markRegistered()
+	r.notify("register", aws.ToString(changeSets[len(changeSets)-1].ChangeInfo.Id))
+	return nil
+}
+
+// conflictError explains a conflict error and how to resolve it
+func (r *Registrar) conflictError(err error) error {
+	names := strings.Join(r.Names, ",")
+	if existing := conflictingType(err); existing != "" {
+		return fmt.Errorf("failed to create DNS, a %s record already exists for %s and Route53 does not allow our %s record next to it; use -recordtype %s, delete the existing record or set -overwriteconflicting to replace it: %w", existing, names, r.RecordType, existing, err)
+	}
+	return fmt.Errorf("failed to create DNS, a record of a different type already exists for %s and Route53 does not allow our %s record next to it; delete the existing record or set -overwriteconflicting to replace it: %w", names, r.RecordType, err)
+}
+
+// conflictingChanges returns the deletes of the records of our names with type rrType, or of any type but ours when rrType is empty
+func (r *Registrar) conflictingChanges(ctx context.Context, rrType types.RRType) ([]types.Change, error) {
+	var changes []types.Change
+	for _, name := range r.recordNames() {
+		found, err := r.listRecordSets(ctx, name, rrType)
+		if err != nil {
+			return nil, err
+		}
+		for _, rrs := range found {
+			rrs := rrs
+			switch rrs.Type {
+			case r.RecordType, types.RRTypeNs, types.RRTypeSoa:
+				continue
+			}
+			if rrs.Type == types.RRTypeTxt && r.TXTValue != "" {
+				continue // our own companion record
+			}
+			changes = append(changes, types.Change{Action: types.ChangeActionDelete, ResourceRecordSet: &rrs})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, errors.New("no conflicting records found")
+	}
+	for _, change := range changes {
+		r.logger().Warnf("Deleting the conflicting %s record %s", change.ResourceRecordSet.Type, aws.ToString(change.ResourceRecordSet.Name))
+	}
+	return changes, nil
+}
+
+// refresh re-runs the upsert every RefreshInterval so the record heals if deleted externally,
+// and whenever RefreshTrigger fires, until ctx is done
+func (r *Registrar) refresh(ctx context.Context) {
+	var tick <-chan time.Time
+	if r.RefreshInterval > 0 {
+		ticker := time.NewTicker(r.RefreshInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			log.Debug("Refreshing Route 53 DNS record")
+		case <-r.RefreshTrigger:
+			log.Info("Refresh requested, re-registering Route 53 DNS record")
+		}
+		if leader, err := r.acquireLeadership(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Failed to refresh DNS: %v", err)
+			continue
+		} else if !leader {
+			continue
+		}
+		if r.ResolveIP != nil {
+			if moved, err := r.readdress(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("Failed to move DNS to the new IP address: %v", err)
+				continue
+			} else if moved {
+				continue
+			}
+		}
+		if err := r.upsert(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Failed to refresh DNS: %v", err)
+		}
+	}
+}
+
+// readdress re-resolves the IP address and, when it changed, replaces the records of the old address
+// with records of the new one in a single batch. It reports whether the records were moved.
+func (r *Registrar) readdress(ctx context.Context) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ip, err := r.ResolveIP(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to re-resolve the IP address: %w", err)
+	} else if ip == r.IPAddress {
+		return false, nil
+	}
+	if _, err := resolveRecordType(string(r.RecordType), ip); err != nil {
+		return false, fmt.Errorf("new IP address does not fit the %s record: %w", r.RecordType, err)
+	}
+
+	l := r.logger()
+	l.Infof("IP address changed to %s, moving the DNS records", ip)
+	old, oldID := r.IPAddress, r.recordSetIdentifier()
+	deletes := r.changes(types.ChangeActionDelete)
+	r.IPAddress = ip
+	changes := r.changes(types.ChangeActionUpsert)
+	if r.recordSetIdentifier() != oldID || r.RecordType == types.RRTypePtr {
+		// Otherwise the upsert replaces the old value of the same record set
+		changes = append(deletes, changes...)
+	}
+	input := &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch:  &types.ChangeBatch{Changes: changes, Comment: aws.String(r.Comment)},
+		HostedZoneId: aws.String(r.HostedZone),
+	}
+	if r.DryRun {
+		return true, logDryRun(input, r.DryRunOutput)
+	}
+	changeSet, err := r.changeResourceRecordSets(ctx, input)
+	if err != nil {
+		r.IPAddress = old // retried on the next refresh
+		return false, err
+	}
+	r.markRegistered() // resolvers cache the new records for the full TTL from now on
+	r.logger().With("changeId", aws.ToString(changeSet.ChangeInfo.Id)).Info("Request sent to Route 53...")
+	if r.Wait {
+		if err := r.waitForSync(ctx, changeSet); err != nil {
+			return true, err
+		}
+	}
+	r.notify("register", aws.ToString(changeSet.ChangeInfo.Id))
+	return true, nil
+}
+
+// changes builds the changes for every DNS name (and its TXT record) so they are applied in a single atomic batch
+func (r *Registrar) changes(action types.ChangeAction) []types.Change {
+	if r.RecordType == types.RRTypePtr {
+		return []types.Change{{Action: action, ResourceRecordSet: r.ptrRecordSet()}}
+	}
+	var changes []types.Change
+	for _, name := range r.Names {
+		changes = append(changes, types.Change{
+			Action:            action,
+			ResourceRecordSet: r.resourceRecordSet(name),
+		})
+		if r.IPv6Address != "" {
+			changes = append(changes, types.Change{
+				Action:            action,
+				ResourceRecordSet: r.recordSet(name, types.RRTypeAaaa, r.IPv6Address),
+			})
+		}
+		if r.TXTValue != "" {
+			changes = append(changes, types.Change{
+				Action:            action,
+				ResourceRecordSet: r.txtRecordSet(name),
+			})
+		}
+	}
+	return changes
+}
+
+// existingChanges drops the changes whose record set no longer exists in the hosted zone.
+// With DeleteFetched the changes use the record sets as found, Route53 only deletes exact matches.
+func (r *Registrar) existingChanges(ctx context.Context, changes []types.Change) ([]types.Change, error) {
+	var existing []types.Change
+	for _, change := range changes {
+		rrs := change.ResourceRecordSet
+		found, err := r.listRecordSets(ctx, aws.ToString(rrs.Name), rrs.Type)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range found {
+			if aws.ToString(other.SetIdentifier) == aws.ToString(rrs.SetIdentifier) {
+				if r.DeleteFetched {
+					other := other
+					change.ResourceRecordSet = &other
+				}
+				existing = append(existing, change)
+				break
+			}
+		}
+	}
+	return existing, nil
+}
+
+// unchanged reports whether every record of changes already exists exactly as it would be upserted
+func (r *Registrar) unchanged(ctx context.Context, changes []types.Change) (bool, error) {
+	for _, change := range changes {
+		want := change.ResourceRecordSet
+		found, err := r.listRecordSets(ctx, aws.ToString(want.Name), want.Type)
+		if err != nil {
+			return false, err
+		}
+		if !slices.ContainsFunc(found, func(got types.ResourceRecordSet) bool { return sameRecordSet(&got, want) }) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sameRecordSet compares the fields of record sets that we set
+func sameRecordSet(a, b *types.ResourceRecordSet) bool {
+	if !sameDomainName(aws.ToString(a.Name), aws.ToString(b.Name)) || a.Type != b.Type ||
+		aws.ToString(a.SetIdentifier) != aws.ToString(b.SetIdentifier) ||
+		aws.ToInt64(a.TTL) != aws.ToInt64(b.TTL) || aws.ToInt64(a.Weight) != aws.ToInt64(b.Weight) ||
+		aws.ToBool(a.MultiValueAnswer) != aws.ToBool(b.MultiValueAnswer) || a.Region != b.Region ||
+		(a.GeoLocation == nil) != (b.GeoLocation == nil) || (a.AliasTarget == nil) != (b.AliasTarget == nil) ||
+		len(a.ResourceRecords) != len(b.ResourceRecords) {
+		return false
+	}
+	if a.GeoLocation != nil && (aws.ToString(a.GeoLocation.ContinentCode) != aws.ToString(b.GeoLocation.ContinentCode) ||
+		aws.ToString(a.GeoLocation.CountryCode) != aws.ToString(b.GeoLocation.CountryCode) ||
+		aws.ToString(a.GeoLocation.SubdivisionCode) != aws.ToString(b.GeoLocation.SubdivisionCode)) {
+		return false
+	}
+	if a.AliasTarget != nil && (!sameDomainName(aws.ToString(a.AliasTarget.DNSName), aws.ToString(b.AliasTarget.DNSName)) ||
+		aws.ToString(a.AliasTarget.HostedZoneId) != aws.ToString(b.AliasTarget.HostedZoneId) ||
+		a.AliasTarget.EvaluateTargetHealth != b.AliasTarget.EvaluateTargetHealth) {
+		return false
+	}
+	for i := range a.ResourceRecords {
+		if aws.ToString(a.ResourceRecords[i].Value) != aws.ToString(b.ResourceRecords[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// staleChanges returns deletes for the records of our names that follow the default SetIdentifier
+// scheme, i.e. the identifier is the record's own value, but belong to another value than ours.
+// Such records, and their AAAA and TXT companions, were left behind by tasks that were killed before they could tear down.
+func (r *Registrar) staleChanges(ctx context.Context) ([]types.Change, error) {
+	var changes []types.Change
+	for _, name := range r.recordNames() {
+		found, err := r.listRecordSets(ctx, name, r.RecordType)
+		if err != nil {
+			return nil, err
+		}
+		staleIDs := map[string]bool{}
+		for _, rrs := range found {
+			rrs := rrs
+			id := aws.ToString(rrs.SetIdentifier)
+			if id == "" || id == r.recordSetIdentifier() || len(rrs.ResourceRecords) != 1 || aws.ToString(rrs.ResourceRecords[0].Value) != id {
+				continue
+			}
+			staleIDs[id] = true
+			changes = append(changes, types.Change{Action: types.ChangeActionDelete, ResourceRecordSet: &rrs})
+		}
+		if len(staleIDs) == 0 {
+			continue
+		}
+
+		// The dual-stack AAAA and companion TXT records share the identifier of their record, not its value
+		var companions []types.RRType
+		if r.IPv6Address != "" {
+			companions = append(companions, types.RRTypeAaaa)
+		}
+		if r.TXTValue != "" {
+			companions = append(companions, types.RRTypeTxt)
+		}
+		for _, rrType := range companions {
+			found, err = r.listRecordSets(ctx, name, rrType)
+			if err != nil {
+				return nil, err
+			}
+			for _, rrs := range found {
+				rrs := rrs
+				if staleIDs[aws.ToString(rrs.SetIdentifier)] {
+					changes = append(changes, types.Change{Action: types.ChangeActionDelete, ResourceRecordSet: &rrs})
+				}
+			}
+		}
+	}
+	return changes, nil
+}
+
+// errIdentifierCollision is returned by checkIdentifier when records of another value use our SetIdentifier
+var errIdentifierCollision = errors.New("SetIdentifier already in use")
+
+// checkIdentifier fails with errIdentifierCollision when one of our names already has a record of our type and SetIdentifier
+// with other values, e.g. of a sibling task given the same -setidentifier, which upserting would overwrite.
+// TXT records, whose value is the version, and alias records are not checked.
+func (r *Registrar) checkIdentifier(ctx context.Context) error {
+	var collisions []string
+	for _, change := range r.changes(types.ChangeActionUpsert) {
+		want := change.ResourceRecordSet
+		if want.SetIdentifier == nil || want.Type == types.RRTypeTxt || want.AliasTarget != nil {
+			continue
+		}
+		found, err := r.listRecordSets(ctx, aws.ToString(want.Name), want.Type)
+		if err != nil {
+			return fmt.Errorf("unable to check SetIdentifier %s for collisions: %w", aws.ToString(want.SetIdentifier), err)
+		}
+		for _, got := range found {
+			if aws.ToString(got.SetIdentifier) == aws.ToString(want.SetIdentifier) && recordValues(&got) != recordValues(want) {
+				collisions = append(collisions, fmt.Sprintf("%s %s => %s", got.Type, aws.ToString(got.Name), recordValues(&got)))
+			}
+		}
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("%w: %s %s is used by %s, upserting would overwrite them; set a -setidentifier unique to this task",
+			errIdentifierCollision, r.RecordType, r.recordSetIdentifier(), strings.Join(collisions, ", "))
+	}
+	return nil
+}
+
+// recordValues joins the values of a record set, for comparison and logging
+func recordValues(rrs *types.ResourceRecordSet) string {
+	var values []string
+	for _, rr := range rrs.ResourceRecords {
+		values = append(values, aws.ToString(rr.Value))
+	}
+	return strings.Join(values, ",")
+}
+
+// listRecordSets returns all record sets of the hosted zone with the given name and type, or of any type when rrType is empty
+func (r *Registrar) listRecordSets(ctx context.Context, name string, rrType types.RRType) ([]types.ResourceRecordSet, error) {
+	input := &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(r.HostedZone),
+		StartRecordName: aws.String(name),
+		StartRecordType: rrType,
+	}
+	var found []types.ResourceRecordSet
+	for {
+		var output *route53.ListResourceRecordSetsOutput
+		err := callWithTimeout(ctx, r.APITimeout, func(ctx context.Context) (err error) {
+			output, err = r.API.ListResourceRecordSets(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Record sets are sorted by name and type, so stop at the first one past ours
+		for _, rrs := range output.ResourceRecordSets {
+			if !sameDomainName(aws.ToString(rrs.Name), name) || (rrType != "" && rrs.Type != rrType) {
+				return found, nil
+			}
+			found = append(found, rrs)
+		}
+		if !output.IsTruncated {
+			return found, nil
+		}
+		input.StartRecordName = output.NextRecordName
+		input.StartRecordType = output.NextRecordType
+		input.StartRecordIdentifier = output.NextRecordIdentifier
+	}
+}
+
+// recordValue is the alias target, the target name for CNAME records, the SRV value, or the IP address otherwise
+func (r *Registrar) recordValue() string {
+	if r.AliasTarget != "" {
+		return r.AliasTarget
+	}
+	switch r.RecordType {
+	case types.RRTypeCname:
+		return r.Target
+	case types.RRTypeSrv:
+		return srvValue(r.SRVPriority, r.SRVWeight, r.SRVPort, r.Target)
+	}
+	return r.IPAddress
+}
+
+// recordSetIdentifier is the configured SetIdentifier, or the record value when none is set
+func (r *Registrar) recordSetIdentifier() string {
+	if r.SetIdentifier != "" {
+		return r.SetIdentifier
+	}
+	return r.recordValue()
+}
+
+// resourceRecordSet builds the record for name, the same shape is used for upsert and delete
+func (r *Registrar) resourceRecordSet(name string) *types.ResourceRecordSet {
+	rrs := r.recordSet(name, r.RecordType, r.recordValue())
+	if r.RecordType == types.RRTypeA || r.RecordType == types.RRTypeAaaa {
+		for _, ip := range r.ExtraIPAddresses {
+			rrs.ResourceRecords = append(rrs.ResourceRecords, types.ResourceRecord{Value: aws.String(ip)})
+		}
+	}
+	if r.AliasTarget != "" {
+		// Alias records take their values and TTL from the target
+		rrs.ResourceRecords = nil
+		rrs.TTL = nil
+		rrs.AliasTarget = &types.AliasTarget{
+			DNSName:              aws.String(r.AliasTarget),
+			HostedZoneId:         aws.String(r.AliasZone),
+			EvaluateTargetHealth: r.EvaluateTargetHealth,
+		}
+	}
+	return rrs
+}
+
+// ptrRecordSet builds the reverse record of the IP address, pointing to every DNS name
+func (r *Registrar) ptrRecordSet() *types.ResourceRecordSet {
+	name, _ := reverseName(r.IPAddress) // validated
+	rrs := r.recordSet(name, types.RRTypePtr, "")
+	rrs.ResourceRecords = nil
+	for _, host := range r.Names {
+		rrs.ResourceRecords = append(rrs.ResourceRecords, types.ResourceRecord{Value: aws.String(strings.TrimSuffix(host, ".") + ".")})
+	}
+	return rrs
+}
+
+// recordNames are the names of our records, the reverse name for PTR records
+func (r *Registrar) recordNames() []string {
+	if r.RecordType == types.RRTypePtr {
+		name, _ := reverseName(r.IPAddress)
+		return []string{name}
+	}
+	return r.Names
+}
+
+// txtRecordSet builds the companion TXT record, {version} in TXTValue is replaced by the build version
+func (r *Registrar) txtRecordSet(name string) *types.ResourceRecordSet {
+	value := strings.ReplaceAll(r.TXTValue, "{version}", version)
+	return r.recordSet(name, types.RRTypeTxt, quoteTXT(value))
+}
+
+// ttl is the TTL of name, its override when there is one
+func (r *Registrar) ttl(name string) int {
+	ttl, ok := r.TTLs[name]
+	if !ok {
+		ttl = r.TTL
+	}
+	return max(ttl, r.MinTTL) // the same for setup and teardown, so the delete matches
+}
+
+// maxTTL is the longest TTL of our names, how long resolvers may cache any of them
+func (r *Registrar) maxTTL() int {
+	longest := 0
+	for _, name := range r.Names {
+		longest = max(longest, r.ttl(name))
+	}
+	return longest
+}
+
+// recordSet builds a single value record set with the configured TTL and routing policy
+func (r *Registrar) recordSet(name string, rrType types.RRType, value string) *types.ResourceRecordSet {
+	rrs := &types.ResourceRecordSet{
+		Name: aws.String(name),
+		ResourceRecords: []types.ResourceRecord{
+			{
+				Value: aws.String(value),
+			},
+		},
+		TTL:  aws.Int64(int64(r.ttl(name))),
+		Type: rrType,
+	}
+	switch r.RoutingPolicy {
+	case routingWeighted:
+		rrs.Weight = aws.Int64(r.Weight)
+		rrs.SetIdentifier = aws.String(r.recordSetIdentifier())
+	case routingMultiValue:
+		rrs.MultiValueAnswer = aws.Bool(true)
+		rrs.SetIdentifier = aws.String(r.recordSetIdentifier())
+	case routingLatency:
+		rrs.Region = types.ResourceRecordSetRegion(r.Region)
+		rrs.SetIdentifier = aws.String(r.recordSetIdentifier())
+	case routingGeolocation:
+		rrs.GeoLocation = r.GeoLocation
+		rrs.SetIdentifier = aws.String(r.recordSetIdentifier())
+	}
+	return rrs
+}
+
+// logger returns a logger with the record being changed as context
+func (r *Registrar) logger() *logger {
+	return log.With("dns", strings.Join(r.Names, ","), "ip", r.recordValue(), "zone", r.HostedZone)
+}
+
+// changeResourceRecordSets submits the change, retrying transient errors with exponential backoff
+func (r *Registrar) changeResourceRecordSets(ctx context.Context, input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	var changeSet *route53.ChangeResourceRecordSetsOutput
+	err := retryWithBackoff(ctx, r.MaxRetries, r.RetryBaseDelay, isTransientError, func() error {
+		return callWithTimeout(ctx, r.APITimeout, func(ctx context.Context) (err error) {
+			changeSet, err = r.API.ChangeResourceRecordSets(ctx, input)
+			return err
+		})
+	})
+	if err == nil {
+		r.savePending(changeSet)
+	}
+	return changeSet, classifyAPIError(err)
+}
+
+// nextPollInterval returns the wait before the poll after one that waited interval, backing off up to SyncPollMax
+func (r *Registrar) nextPollInterval(interval time.Duration) time.Duration {
+	if r.SyncPollMax <= r.SyncPollInterval {
+		return r.SyncPollInterval
+	}
+	return min(2*interval, r.SyncPollMax)
+}
+
+func (r *Registrar) waitForSync(ctx context.Context, changeSet *route53.ChangeResourceRecordSetsOutput) error {
+	l := r.logger().With("changeId", aws.ToString(changeSet.ChangeInfo.Id))
+	parent := ctx
+	if r.SyncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.SyncTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	failures, polls := 0, 0
+	interval := r.SyncPollInterval
+	for {
+		if err := SleepWithContext(ctx, interval); err != nil {
+			if parent.Err() == nil {
+				l.Warnf("Route53 ChangeSet not propagated after %v, giving up", r.SyncTimeout)
+				return fmt.Errorf("change %s not INSYNC after %v: %w", aws.ToString(changeSet.ChangeInfo.Id), r.SyncTimeout, withKind(errPropagationTimeout, err))
+			}
+			l.Warn("Context cancelled, stop waiting for Route53 ChangeSet to propogate")
+			return err
+		}
+
+		polls++
+		interval = r.nextPollInterval(interval)
+		var changeOutput *route53.GetChangeOutput
+		err := callWithTimeout(ctx, r.APITimeout, func(ctx context.Context) (err error) {
+			changeOutput, err = r.API.GetChange(ctx, &route53.GetChangeInput{
+				Id: changeSet.ChangeInfo.Id,
+			})
+			return err
+		})
+
+		if err != nil && ctx.Err() == nil && !isTransientError(err) {
+			return fmt.Errorf("failed getting the status of change %s: %w", aws.ToString(changeSet.ChangeInfo.Id), err)
+		} else if err != nil {
+			l.Warnf("Failed getting ChangeSet result: %v", err)
+			if failures++; failures > r.SyncMaxFailures && ctx.Err() == nil {
+				return fmt.Errorf("failed %d times getting the status of change %s, it may still propagate: %w", failures, aws.ToString(changeSet.ChangeInfo.Id), err)
+			}
+			continue
+		}
+
+		if changeOutput.ChangeInfo.Status == "INSYNC" {
+			elapsed := time.Since(start)
+			syncDuration.Observe(elapsed.Seconds())
+			l.With("polls", polls, "duration", elapsed.Round(time.Millisecond).String()).Info("Route53 Change Completed")
+			r.clearPending()
+			return nil
+		}
+
+		l.Debugf("Route53 Change not yet propogated (ChangeInfo.Status = %s)...", changeOutput.ChangeInfo.Status)
+	}
+}
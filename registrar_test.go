@@ -0,0 +1,1301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// testRegistrar returns a weighted A record my.example.com => 10.0.0.1 in zone Z123 which polls and retries quickly
+func testRegistrar(api route53API) *Registrar {
+	return &Registrar{
+		API:              api,
+		Names:            []string{"my.example.com"},
+		HostedZone:       "Z123",
+		RecordType:       types.RRTypeA,
+		IPAddress:        "10.0.0.1",
+		Comment:          "route53-sidecar",
+		RoutingPolicy:    routingWeighted,
+		Weight:           100,
+		Wait:             true,
+		MaxRetries:       5,
+		RetryBaseDelay:   time.Millisecond,
+		SyncPollInterval: time.Millisecond,
+		SyncMaxFailures:  3,
+	}
+}
+
+func Test_resourceRecordSet(t *testing.T) {
+	tests := []struct {
+		ip         string
+		recordType types.RRType
+	}{
+		{"10.0.0.1", types.RRTypeA},
+		{"2001:db8::1", types.RRTypeAaaa},
+	}
+	for _, tt := range tests {
+		r := testRegistrar(nil)
+		r.IPAddress = tt.ip
+		r.RecordType = tt.recordType
+		rrs := r.resourceRecordSet("my.example.com")
+		if rrs.Type != tt.recordType {
+			t.Errorf("resourceRecordSet().Type = %v, want %v", rrs.Type, tt.recordType)
+		}
+		if got := *rrs.ResourceRecords[0].Value; got != tt.ip {
+			t.Errorf("resourceRecordSet() value = %v, want %v", got, tt.ip)
+		}
+	}
+}
+
+func Test_changesMinTTL(t *testing.T) {
+	r := testRegistrar(nil)
+	r.Names = []string{"my.example.com", "fast.example.com"}
+	r.TTL = 5
+	r.TTLs = map[string]int{"fast.example.com": 1}
+	r.MinTTL = 30
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		for _, change := range r.changes(action) {
+			if got := aws.ToInt64(change.ResourceRecordSet.TTL); got != 30 {
+				t.Errorf("%v %s TTL = %d, want the minimum 30", action, aws.ToString(change.ResourceRecordSet.Name), got)
+			}
+		}
+	}
+	if got := r.maxTTL(); got != 30 {
+		t.Errorf("maxTTL() = %d, want 30", got)
+	}
+}
+
+func Test_resourceRecordSetMultipleIPs(t *testing.T) {
+	r := testRegistrar(nil)
+	r.ExtraIPAddresses = []string{"10.0.1.1", "10.0.2.1"}
+	if err := r.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	rrs := r.resourceRecordSet("my.example.com")
+	var got []string
+	for _, rr := range rrs.ResourceRecords {
+		got = append(got, aws.ToString(rr.Value))
+	}
+	if strings.Join(got, ",") != "10.0.0.1,10.0.1.1,10.0.2.1" {
+		t.Errorf("ResourceRecords = %v, want the three addresses", got)
+	}
+	if got := aws.ToString(rrs.SetIdentifier); got != r.IPAddress {
+		t.Errorf("SetIdentifier = %v, want the first address %v", got, r.IPAddress)
+	}
+}
+
+func Test_RegisterDualStack(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.IPv6Address = "2001:db8::1"
+	if err := r.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	r.SkipTTLWait = true
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 2 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 2", len(mock.inputs))
+	}
+	for i, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		var got []string
+		for _, change := range mock.inputs[i].ChangeBatch.Changes {
+			if change.Action != action {
+				t.Errorf("change %s, want %s", change.Action, action)
+			}
+			got = append(got, string(change.ResourceRecordSet.Type)+" "+aws.ToString(change.ResourceRecordSet.ResourceRecords[0].Value))
+		}
+		if strings.Join(got, ",") != "A 10.0.0.1,AAAA 2001:db8::1" {
+			t.Errorf("%s batch = %v, want the A and the AAAA record", action, got)
+		}
+	}
+}
+
+func Test_checkIdentifier(t *testing.T) {
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.SetIdentifier = "blue"
+	if err := r.checkIdentifier(context.Background()); err != nil {
+		t.Errorf("checkIdentifier() with no records error = %v", err)
+	}
+
+	ours := r.resourceRecordSet("my.example.com")
+	mock.records[recordKey(ours)] = *ours
+	if err := r.checkIdentifier(context.Background()); err != nil {
+		t.Errorf("checkIdentifier() with our own record error = %v", err)
+	}
+
+	sibling := r.resourceRecordSet("my.example.com")
+	sibling.ResourceRecords = []types.ResourceRecord{{Value: aws.String("10.0.0.2")}}
+	mock.records[recordKey(sibling)] = *sibling
+	err := r.checkIdentifier(context.Background())
+	if !errors.Is(err, errIdentifierCollision) || !strings.Contains(err.Error(), "10.0.0.2") {
+		t.Errorf("checkIdentifier() error = %v, want %v naming the record of 10.0.0.2", err, errIdentifierCollision)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 0", len(mock.inputs))
+	}
+}
+
+func Test_changesMultipleNames(t *testing.T) {
+	r := testRegistrar(nil)
+	r.Names = []string{"api.example.com", "api-internal.example.com"}
+
+	got := r.changes(types.ChangeActionUpsert)
+	if len(got) != 2 {
+		t.Fatalf("changes() returned %d changes, want 2", len(got))
+	}
+	for i, want := range r.Names {
+		if got[i].Action != types.ChangeActionUpsert {
+			t.Errorf("changes()[%d].Action = %v, want %v", i, got[i].Action, types.ChangeActionUpsert)
+		}
+		if name := *got[i].ResourceRecordSet.Name; name != want {
+			t.Errorf("changes()[%d] name = %v, want %v", i, name, want)
+		}
+	}
+}
+
+func Test_Register(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if got := *mock.inputs[0].HostedZoneId; got != r.HostedZone {
+		t.Errorf("HostedZoneId = %v, want %v", got, r.HostedZone)
+	}
+	if got := mock.inputs[0].ChangeBatch.Changes[0].Action; got != types.ChangeActionUpsert {
+		t.Errorf("Action = %v, want %v", got, types.ChangeActionUpsert)
+	}
+	if mock.getChangeCalls != 1 {
+		t.Errorf("GetChange called %d times, want 1", mock.getChangeCalls)
+	}
+}
+
+func Test_Unregister(t *testing.T) {
+	mock := &mockRoute53{}
+	if err := testRegistrar(mock).Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if got := mock.inputs[0].ChangeBatch.Changes[0].Action; got != types.ChangeActionDelete {
+		t.Errorf("Action = %v, want %v", got, types.ChangeActionDelete)
+	}
+}
+
+func Test_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	if err := testRegistrar(mock).Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(mock.inputs) != 2 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 2", len(mock.inputs))
+	}
+	for i, want := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		if got := mock.inputs[i].ChangeBatch.Changes[0].Action; got != want {
+			t.Errorf("change %d Action = %v, want %v", i, got, want)
+		}
+	}
+	if len(mock.records) != 0 {
+		t.Errorf("got %d records after Run(), want 0", len(mock.records))
+	}
+}
+
+func Test_RunNoTeardown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.NoTeardown = true
+	if err := r.Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	for i, input := range mock.inputs {
+		if got := input.ChangeBatch.Changes[0].Action; got != types.ChangeActionUpsert {
+			t.Errorf("change %d Action = %v, want only %v", i, got, types.ChangeActionUpsert)
+		}
+	}
+	if len(mock.records) != 1 {
+		t.Errorf("got %d records after Run(), want the record kept", len(mock.records))
+	}
+}
+
+func Test_RunForceQuit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	quit := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(quit) })
+
+	r := testRegistrar(&mockRoute53{})
+	r.TTL = 3600
+	r.ForceQuit = quit
+	start := time.Now()
+	if err := r.Run(ctx); err != nil {
+		t.Errorf("Run() error = %v, want the TTL wait cut short after the delete", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run() took %v after the second signal", elapsed)
+	}
+}
+
+func Test_RegisterError(t *testing.T) {
+	wantErr := errors.New("access denied")
+	mock := &mockRoute53{wantErrs: []error{wantErr}}
+	if err := testRegistrar(mock).Register(context.Background()); !errors.Is(err, wantErr) {
+		t.Errorf("Register() error = %v, want %v", err, wantErr)
+	}
+	if mock.getChangeCalls != 0 {
+		t.Errorf("GetChange called %d times, want 0", mock.getChangeCalls)
+	}
+}
+
+func Test_waitForSyncCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mock := &mockRoute53{}
+	changeSet := &route53.ChangeResourceRecordSetsOutput{ChangeInfo: &types.ChangeInfo{Id: aws.String("C123")}}
+	if err := testRegistrar(mock).waitForSync(ctx, changeSet); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForSync() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func Test_RegisterRetriesTransientErrors(t *testing.T) {
+	mock := &mockRoute53{wantErrs: []error{&types.PriorRequestNotComplete{}, &types.ThrottlingException{}}}
+	if err := testRegistrar(mock).Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 3 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 3", len(mock.inputs))
+	}
+}
+
+func Test_resourceRecordSetCNAME(t *testing.T) {
+	r := testRegistrar(nil)
+	r.RecordType = types.RRTypeCname
+	r.Target = "my-lb-123.us-west-2.elb.amazonaws.com"
+
+	rrs := r.resourceRecordSet("api.example.com")
+	if rrs.Type != types.RRTypeCname {
+		t.Errorf("resourceRecordSet().Type = %v, want %v", rrs.Type, types.RRTypeCname)
+	}
+	if got := *rrs.ResourceRecords[0].Value; got != r.Target {
+		t.Errorf("resourceRecordSet() value = %v, want %v", got, r.Target)
+	}
+}
+
+func Test_RegisterConflict(t *testing.T) {
+	conflict := &types.InvalidChangeBatch{
+		Message: aws.String("[RRSet of type A with DNS name my.example.com. is not permitted because a conflicting RRSet of type CNAME with the same DNS name already exists in zone example.com.]"),
+	}
+	mock := &mockRoute53{wantErrs: []error{conflict}}
+	err := testRegistrar(mock).Register(context.Background())
+	if !isConflictError(err) {
+		t.Fatalf("Register() error = %v, want conflict error", err)
+	}
+	var invalidBatch *types.InvalidChangeBatch
+	if !errors.Is(err, errRecordConflict) || !errors.As(err, &invalidBatch) {
+		t.Errorf("Register() error = %v, want errRecordConflict wrapping the InvalidChangeBatch", err)
+	}
+	for _, want := range []string{"a CNAME record already exists for my.example.com", "-recordtype CNAME", "-overwriteconflicting"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Register() error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func Test_RegisterOverwriteConflicting(t *testing.T) {
+	conflict := &types.InvalidChangeBatch{
+		Message: aws.String("[RRSet of type A with DNS name my.example.com. is not permitted because a conflicting RRSet of type CNAME with the same DNS name already exists in zone example.com.]"),
+	}
+	cname := &types.ResourceRecordSet{
+		Name:            aws.String("my.example.com."),
+		Type:            types.RRTypeCname,
+		TTL:             aws.Int64(300),
+		ResourceRecords: []types.ResourceRecord{{Value: aws.String("old.example.com")}},
+	}
+	mock := &mockRoute53{wantErrs: []error{conflict}, records: map[string]types.ResourceRecordSet{recordKey(cname): *cname}}
+	r := testRegistrar(mock)
+	r.OverwriteConflicting = true
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 2 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want the upsert and the replacing batch", len(mock.inputs))
+	}
+	replaced := mock.inputs[1].ChangeBatch.Changes
+	if len(replaced) != 2 || replaced[0].Action != types.ChangeActionDelete || replaced[0].ResourceRecordSet.Type != types.RRTypeCname ||
+		replaced[1].Action != types.ChangeActionUpsert || replaced[1].ResourceRecordSet.Type != types.RRTypeA {
+		t.Errorf("second batch = %+v, want the delete of the CNAME and the upsert of the A record", replaced)
+	}
+	if _, ok := mock.records[recordKey(cname)]; ok {
+		t.Error("CNAME record still exists")
+	}
+	if _, ok := mock.records[recordKey(r.resourceRecordSet("my.example.com"))]; !ok {
+		t.Error("A record not created")
+	}
+}
+
+func Test_RegisterOverwriteConflictingFails(t *testing.T) {
+	conflict := &types.InvalidChangeBatch{
+		Message: aws.String("[RRSet of type A with DNS name my.example.com. is not permitted because a conflicting RRSet of type CNAME with the same DNS name already exists in zone example.com.]"),
+	}
+	invalid := &types.InvalidChangeBatch{Message: aws.String("[Tried to delete resource record set [name='my.example.com.', type='CNAME'] but the values provided do not match the current values]")}
+	cname := &types.ResourceRecordSet{
+		Name:            aws.String("my.example.com."),
+		Type:            types.RRTypeCname,
+		TTL:             aws.Int64(300),
+		ResourceRecords: []types.ResourceRecord{{Value: aws.String("old.example.com")}},
+	}
+	mock := &mockRoute53{wantErrs: []error{conflict, invalid}, records: map[string]types.ResourceRecordSet{recordKey(cname): *cname}}
+	r := testRegistrar(mock)
+	r.Names = []string{"my.example.com", "www.example.com"}
+	r.OverwriteConflicting = true
+	r.SplitInvalidBatch = true
+
+	if err := r.Register(context.Background()); !errors.Is(err, invalid) {
+		t.Errorf("Register() error = %v, want the error of the replacing batch", err)
+	}
+	if len(mock.inputs) != 2 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want the upsert and the replacing batch only, not split", len(mock.inputs))
+	}
+}
+
+func Test_RegisterSkipUnchanged(t *testing.T) {
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.SkipUnchanged = true
+	existing := r.resourceRecordSet("my.example.com")
+	mock.records[recordKey(existing)] = *existing
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 0 for an identical record", len(mock.inputs))
+	}
+
+	r.Weight = 200
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 1 after the weight changed", len(mock.inputs))
+	}
+}
+
+func Test_RegisterSplitInvalidBatch(t *testing.T) {
+	invalid := &types.InvalidChangeBatch{Message: aws.String("RRSet with DNS name bad_name.example.com. is not permitted")}
+	mock := &mockRoute53{wantErrs: []error{invalid, nil, invalid}, records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.Names = []string{"my.example.com", "bad_name.example.com"}
+	r.SplitInvalidBatch = true
+
+	if err := r.Register(context.Background()); !isInvalidBatchError(err) {
+		t.Fatalf("Register() error = %v, want the rejected record", err)
+	}
+	if len(mock.inputs) != 3 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want the batch and each record", len(mock.inputs))
+	}
+	for i, name := range r.Names {
+		if changes := mock.inputs[i+1].ChangeBatch.Changes; len(changes) != 1 || aws.ToString(changes[0].ResourceRecordSet.Name) != name {
+			t.Errorf("batch %d = %+v, want only %s", i+1, changes, name)
+		}
+	}
+	if _, ok := mock.records[recordKey(r.resourceRecordSet("my.example.com"))]; !ok {
+		t.Error("the valid record was not applied")
+	}
+}
+
+func Test_resourceRecordSetIdentifierAndWeight(t *testing.T) {
+	r := testRegistrar(nil)
+	rrs := r.resourceRecordSet("my.example.com")
+	if got := *rrs.SetIdentifier; got != r.IPAddress {
+		t.Errorf("default SetIdentifier = %v, want %v", got, r.IPAddress)
+	}
+
+	r.SetIdentifier = "us-west-2-task"
+	r.Weight = 25
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		rrs = r.changes(action)[0].ResourceRecordSet
+		if got := *rrs.SetIdentifier; got != r.SetIdentifier {
+			t.Errorf("%v SetIdentifier = %v, want %v", action, got, r.SetIdentifier)
+		}
+		if got := *rrs.Weight; got != r.Weight {
+			t.Errorf("%v Weight = %v, want %v", action, got, r.Weight)
+		}
+	}
+}
+
+func Test_resourceRecordSetSimple(t *testing.T) {
+	r := testRegistrar(nil)
+	r.RoutingPolicy = routingSimple
+
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		rrs := r.changes(action)[0].ResourceRecordSet
+		if rrs.Weight != nil {
+			t.Errorf("%v Weight = %v, want nil", action, *rrs.Weight)
+		}
+		if rrs.SetIdentifier != nil {
+			t.Errorf("%v SetIdentifier = %v, want nil", action, *rrs.SetIdentifier)
+		}
+	}
+}
+
+func Test_multiValueRecords(t *testing.T) {
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.RoutingPolicy = routingMultiValue
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		r.IPAddress = ip
+		if err := r.Register(context.Background()); err != nil {
+			t.Fatalf("Register(%s) error = %v", ip, err)
+		}
+	}
+	if len(mock.records) != 2 {
+		t.Fatalf("got %d records, want 2 independent records", len(mock.records))
+	}
+	for key, rrs := range mock.records {
+		if rrs.MultiValueAnswer == nil || !*rrs.MultiValueAnswer {
+			t.Errorf("record %s MultiValueAnswer not set", key)
+		}
+		if rrs.Weight != nil {
+			t.Errorf("record %s Weight = %v, want nil", key, *rrs.Weight)
+		}
+	}
+
+	r.IPAddress = "10.0.0.1"
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.records) != 1 {
+		t.Fatalf("got %d records after teardown, want 1", len(mock.records))
+	}
+	for _, rrs := range mock.records {
+		if got := *rrs.SetIdentifier; got != "10.0.0.2" {
+			t.Errorf("remaining SetIdentifier = %v, want 10.0.0.2", got)
+		}
+	}
+}
+
+func Test_refresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.RefreshInterval = 10 * time.Millisecond
+	r.refresh(ctx)
+
+	if len(mock.inputs) < 2 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want more than 1", len(mock.inputs))
+	}
+	for _, input := range mock.inputs {
+		if got := input.ChangeBatch.Changes[0].Action; got != types.ChangeActionUpsert {
+			t.Errorf("Action = %v, want %v", got, types.ChangeActionUpsert)
+		}
+	}
+}
+
+func Test_dryRun(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.DryRun = true
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 0", len(mock.inputs))
+	}
+	if mock.getChangeCalls != 0 {
+		t.Errorf("GetChange called %d times, want 0", mock.getChangeCalls)
+	}
+}
+
+func Test_changesWithTXT(t *testing.T) {
+	r := testRegistrar(nil)
+	r.TXTValue = `commit={version} "quoted"`
+
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		got := r.changes(action)
+		if len(got) != 2 {
+			t.Fatalf("%v: changes() returned %d changes, want 2", action, len(got))
+		}
+		txt := got[1].ResourceRecordSet
+		if txt.Type != types.RRTypeTxt {
+			t.Errorf("%v: Type = %v, want %v", action, txt.Type, types.RRTypeTxt)
+		}
+		want := `"commit=` + version + ` \"quoted\""`
+		if value := *txt.ResourceRecords[0].Value; value != want {
+			t.Errorf("%v: TXT value = %v, want %v", action, value, want)
+		}
+	}
+}
+
+func Test_RegisterSingleBatch(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.Names = []string{"api.example.com", "api-internal.example.com"}
+	r.TXTValue = "owner=route53-sidecar"
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if got := len(mock.inputs[0].ChangeBatch.Changes); got != 4 {
+		t.Errorf("batch has %d changes, want an A and a TXT change for both names", got)
+	}
+	if mock.getChangeCalls != 1 {
+		t.Errorf("GetChange called %d times, want 1", mock.getChangeCalls)
+	}
+}
+
+func Test_RegisterInterruptedDuringDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.SetupDelay = time.Hour
+	err := r.Register(ctx)
+	if !errors.Is(err, errSetupInterrupted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Register() error = %v, want %v", err, errSetupInterrupted)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 0", len(mock.inputs))
+	}
+}
+
+func Test_RegisterInterruptedDuringJitter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.StartupJitter = 1000 * time.Hour
+	start := time.Now()
+	err := r.Register(ctx)
+	if !errors.Is(err, errSetupInterrupted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Register() error = %v, want %v", err, errSetupInterrupted)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Register() took %v after the cancel", elapsed)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 0", len(mock.inputs))
+	}
+}
+
+func Test_RegisterAPITimeout(t *testing.T) {
+	mock := &mockRoute53{hangChanges: 1, hangGetChanges: 1}
+	r := testRegistrar(mock)
+	r.APITimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v, want the hung calls to time out and be retried", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*r.APITimeout || elapsed > 5*time.Second {
+		t.Errorf("Register() took %v, want the two hung calls to time out after %v", elapsed, r.APITimeout)
+	}
+	if len(mock.inputs) != 1 || mock.getChangeCalls != 1 {
+		t.Errorf("got %d changes and %d status checks answered, want 1 each", len(mock.inputs), mock.getChangeCalls)
+	}
+}
+
+func Test_UnregisterSkipTTLWait(t *testing.T) {
+	r := testRegistrar(&mockRoute53{})
+	r.TTL = 3600
+	r.SkipTTLWait = true
+
+	start := time.Now()
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unregister() took %v, want the TTL wait to be skipped", elapsed)
+	}
+}
+
+func Test_UnregisterRemainingTTL(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		remaining bool
+		moved     bool // a refresh moved the records to a new IP address since the upsert
+		wantWait  bool
+	}{
+		{"full TTL", false, false, true},
+		{"remaining TTL", true, false, false},
+		{"remaining TTL after a move", true, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRegistrar(&mockRoute53{})
+			r.TTL = 3600
+			r.WaitRemainingTTL = tt.remaining
+			if err := r.Register(context.Background()); err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			if r.upsertedAt.IsZero() {
+				t.Fatal("Register() did not record the upsert time")
+			}
+			r.upsertedAt = time.Now().Add(-2 * time.Hour)
+			if tt.moved {
+				r.ResolveIP = func(context.Context) (string, error) { return "10.0.0.2", nil }
+				if moved, err := r.readdress(context.Background()); err != nil || !moved {
+					t.Fatalf("readdress() = %v, %v, want the records moved", moved, err)
+				}
+			}
+
+			// The full TTL wait is only cut short by the deadline
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := r.Unregister(ctx); err != nil {
+				t.Fatalf("Unregister() error = %v", err)
+			}
+			if waited := time.Since(start) >= 100*time.Millisecond; waited != tt.wantWait {
+				t.Errorf("Unregister() waited %v, want %v", waited, tt.wantWait)
+			}
+		})
+	}
+}
+
+func Test_UnregisterTTLWaitCancelled(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	ctx, cancel := context.WithCancel(context.Background())
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.TTL = 3600
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := r.Unregister(ctx); err != nil {
+		t.Errorf("Unregister() error = %v, want the teardown to succeed with a shorter drain", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Unregister() took %v after the cancel", elapsed)
+	}
+	if got := buf.String(); !strings.Contains(got, "WARN") || !strings.Contains(got, "DNS Timeout wait interrupted") {
+		t.Errorf("output %q, want a warning that the wait was cut short", got)
+	}
+	if mock.getChangeCalls == 0 {
+		t.Errorf("GetChange not called, want the delete to be in sync before the TTL wait")
+	}
+}
+
+func Test_UnregisterNotFound(t *testing.T) {
+	notFound := &types.InvalidChangeBatch{Message: aws.String("Tried to delete resource record set [name='my.example.com.', type='A', set-identifier='10.0.0.1'] but it was not found")}
+	mock := &mockRoute53{wantErrs: []error{notFound}}
+	if err := testRegistrar(mock).Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v, want nil", err)
+	}
+	if mock.getChangeCalls != 0 {
+		t.Errorf("GetChange called %d times, want 0", mock.getChangeCalls)
+	}
+}
+
+func Test_UnregisterOnlyExistingRecords(t *testing.T) {
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.Names = []string{"gone.example.com", "my.example.com"}
+	existing := r.resourceRecordSet("my.example.com")
+	mock.records[recordKey(existing)] = *existing
+
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if got := mock.inputs[0].ChangeBatch.Changes; len(got) != 1 || *got[0].ResourceRecordSet.Name != "my.example.com" {
+		t.Errorf("deleted %d changes, want only my.example.com", len(got))
+	}
+
+	// Nothing left, the second teardown is a no-op
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("second Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+}
+
+func Test_UnregisterDeleteFetched(t *testing.T) {
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	r := testRegistrar(mock)
+	r.DeleteFetched = true
+	r.SkipTTLWait = true
+	existing := r.resourceRecordSet("my.example.com")
+	existing.TTL = aws.Int64(300) // created before DNSTTL was changed
+	mock.records[recordKey(existing)] = *existing
+
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if got := mock.inputs[0].ChangeBatch.Changes; len(got) != 1 || aws.ToInt64(got[0].ResourceRecordSet.TTL) != 300 {
+		t.Errorf("deleted %+v, want the record with the fetched TTL 300", got)
+	}
+}
+
+func Test_RegisterNoWait(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.Wait = false
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(mock.inputs))
+	}
+	if mock.getChangeCalls != 0 {
+		t.Errorf("GetChange called %d times, want 0", mock.getChangeCalls)
+	}
+
+	// Teardown keeps waiting, the drain depends on it
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if mock.getChangeCalls != 1 {
+		t.Errorf("GetChange called %d times during teardown, want 1", mock.getChangeCalls)
+	}
+}
+
+func Test_waitForSyncTimeout(t *testing.T) {
+	mock := &mockRoute53{pending: true}
+	r := testRegistrar(mock)
+	r.SyncTimeout = 20 * time.Millisecond
+
+	changeSet := &route53.ChangeResourceRecordSetsOutput{ChangeInfo: &types.ChangeInfo{Id: aws.String("C123")}}
+	err := r.waitForSync(context.Background(), changeSet)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errPropagationTimeout) {
+		t.Errorf("waitForSync() error = %v, want %v and %v", err, context.DeadlineExceeded, errPropagationTimeout)
+	}
+	if mock.getChangeCalls == 0 {
+		t.Error("GetChange never called")
+	}
+}
+
+func Test_waitForSyncPollInterval(t *testing.T) {
+	changeSet := &route53.ChangeResourceRecordSetsOutput{ChangeInfo: &types.ChangeInfo{Id: aws.String("C123")}}
+
+	mock := &mockRoute53{pendingPolls: 3}
+	r := testRegistrar(mock)
+	r.SyncPollInterval = 10 * time.Millisecond
+	start := time.Now()
+	if err := r.waitForSync(context.Background(), changeSet); err != nil {
+		t.Fatalf("waitForSync() error = %v", err)
+	}
+	if elapsed := time.Since(start); mock.getChangeCalls != 4 || elapsed < 4*r.SyncPollInterval {
+		t.Errorf("GetChange called %d times in %v, want 4 polls %v apart", mock.getChangeCalls, elapsed, r.SyncPollInterval)
+	}
+
+	// Over the same window, backing off polls far less than the fixed interval
+	polls := func(max time.Duration) int {
+		mock := &mockRoute53{pending: true}
+		r := testRegistrar(mock)
+		r.SyncPollInterval = 5 * time.Millisecond
+		r.SyncPollMax = max
+		r.SyncTimeout = 200 * time.Millisecond
+		if err := r.waitForSync(context.Background(), changeSet); !errors.Is(err, errPropagationTimeout) {
+			t.Errorf("waitForSync() error = %v, want %v", err, errPropagationTimeout)
+		}
+		return mock.getChangeCalls
+	}
+	fixed, backoff := polls(0), polls(80*time.Millisecond)
+	if backoff > 6 || fixed < 3*backoff { // 5, 10, 20, 40, 80, 80ms vs every 5ms
+		t.Errorf("GetChange called %d times with backoff and %d with a fixed interval, want at most 6 and many more", backoff, fixed)
+	}
+}
+
+func Test_nextPollInterval(t *testing.T) {
+	r := testRegistrar(nil)
+	r.SyncPollInterval, r.SyncPollMax = time.Second, 5*time.Second
+	var got []time.Duration
+	for interval := r.SyncPollInterval; len(got) < 5; interval = r.nextPollInterval(interval) {
+		got = append(got, interval)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !slices.Equal(got, want) {
+		t.Errorf("poll intervals = %v, want %v", got, want)
+	}
+	r.SyncPollMax = 0
+	if got := r.nextPollInterval(time.Second); got != time.Second {
+		t.Errorf("nextPollInterval() without SyncPollMax = %v, want the fixed %v", got, time.Second)
+	}
+}
+
+func Test_aliasRecord(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.AliasTarget = "my-alb-123.us-east-1.elb.amazonaws.com"
+	r.AliasZone = "Z35SXDOTRQ7X7K"
+	r.EvaluateTargetHealth = true
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	rrs := mock.inputs[0].ChangeBatch.Changes[0].ResourceRecordSet
+	if rrs.AliasTarget == nil {
+		t.Fatal("AliasTarget not set")
+	}
+	if got := *rrs.AliasTarget.DNSName; got != r.AliasTarget {
+		t.Errorf("AliasTarget.DNSName = %v, want %v", got, r.AliasTarget)
+	}
+	if got := *rrs.AliasTarget.HostedZoneId; got != r.AliasZone {
+		t.Errorf("AliasTarget.HostedZoneId = %v, want %v", got, r.AliasZone)
+	}
+	if !rrs.AliasTarget.EvaluateTargetHealth {
+		t.Error("AliasTarget.EvaluateTargetHealth = false, want true")
+	}
+	if rrs.TTL != nil || rrs.ResourceRecords != nil {
+		t.Errorf("alias record has TTL %v and %d resource records, want neither", rrs.TTL, len(rrs.ResourceRecords))
+	}
+	if got := *rrs.SetIdentifier; got != r.AliasTarget {
+		t.Errorf("SetIdentifier = %v, want %v", got, r.AliasTarget)
+	}
+}
+
+func Test_latencyRecord(t *testing.T) {
+	r := testRegistrar(nil)
+	r.RoutingPolicy = routingLatency
+	r.Region = "eu-west-1"
+
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		rrs := r.changes(action)[0].ResourceRecordSet
+		if rrs.Region != types.ResourceRecordSetRegionEuWest1 {
+			t.Errorf("%v: Region = %v, want %v", action, rrs.Region, types.ResourceRecordSetRegionEuWest1)
+		}
+		if got := aws.ToString(rrs.SetIdentifier); got != "10.0.0.1" {
+			t.Errorf("%v: SetIdentifier = %v, want 10.0.0.1", action, got)
+		}
+		if rrs.Weight != nil || rrs.GeoLocation != nil {
+			t.Errorf("%v: latency record has Weight or GeoLocation set", action)
+		}
+	}
+}
+
+func Test_geolocationRecord(t *testing.T) {
+	r := testRegistrar(nil)
+	r.RoutingPolicy = routingGeolocation
+	r.GeoLocation = &types.GeoLocation{CountryCode: aws.String("US"), SubdivisionCode: aws.String("CA")}
+
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		rrs := r.changes(action)[0].ResourceRecordSet
+		if rrs.GeoLocation == nil || aws.ToString(rrs.GeoLocation.CountryCode) != "US" || aws.ToString(rrs.GeoLocation.SubdivisionCode) != "CA" {
+			t.Errorf("%v: GeoLocation = %+v, want US/CA", action, rrs.GeoLocation)
+		}
+		if rrs.SetIdentifier == nil || rrs.Weight != nil || rrs.Region != "" {
+			t.Errorf("%v: geolocation record has SetIdentifier %v, Weight %v, Region %q", action, rrs.SetIdentifier, rrs.Weight, rrs.Region)
+		}
+	}
+}
+
+func Test_srvRecord(t *testing.T) {
+	r := testRegistrar(nil)
+	r.Names = []string{"_http._tcp.example.com"}
+	r.RecordType = types.RRTypeSrv
+	r.Target = "host.example.com"
+	r.SRVPriority, r.SRVWeight, r.SRVPort = 10, 5, 8080
+
+	const want = "10 5 8080 host.example.com."
+	for _, action := range []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionDelete} {
+		rrs := r.changes(action)[0].ResourceRecordSet
+		if rrs.Type != types.RRTypeSrv {
+			t.Errorf("%v: Type = %v, want %v", action, rrs.Type, types.RRTypeSrv)
+		}
+		if got := *rrs.ResourceRecords[0].Value; got != want {
+			t.Errorf("%v: value = %q, want %q", action, got, want)
+		}
+	}
+	if err := r.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	r.SRVPort = 0
+	if err := r.validate(); err == nil || !strings.Contains(err.Error(), "-srvport") {
+		t.Errorf("validate() error = %v, want -srvport error", err)
+	}
+}
+
+func Test_runOnce(t *testing.T) {
+	// The context is never cancelled, runOnce must not wait for a signal
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock := &mockRoute53{}
+	done := make(chan error, 1)
+	go func() { done <- testRegistrar(mock).runOnce(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runOnce() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("runOnce() blocked")
+	}
+	if len(mock.inputs) != 1 || mock.inputs[0].ChangeBatch.Changes[0].Action != types.ChangeActionUpsert {
+		t.Errorf("runOnce() sent %d change batches, want a single upsert", len(mock.inputs))
+	}
+}
+
+func Test_changeComment(t *testing.T) {
+	const taskARN = "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c"
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.Comment = changeComment("deploy 42", taskARN)
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 2 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 2", len(mock.inputs))
+	}
+	for _, input := range mock.inputs {
+		got := aws.ToString(input.ChangeBatch.Comment)
+		if !strings.Contains(got, "deploy 42") || !strings.Contains(got, taskARN) {
+			t.Errorf("%v comment = %q, want the -comment and the task ARN", input.ChangeBatch.Changes[0].Action, got)
+		}
+	}
+	if got := changeComment("route53-sidecar", ""); got != "route53-sidecar" {
+		t.Errorf("changeComment() without a task ARN = %q", got)
+	}
+}
+
+func Test_registrarsMultipleZones(t *testing.T) {
+	mock := &mockRoute53{}
+	public := testRegistrar(mock)
+	public.HostedZone = "ZPUBLIC"
+	public.IPAddress = "203.0.113.10"
+	private := testRegistrar(mock)
+	private.HostedZone = "ZPRIVATE"
+	rs := registrars{public, private}
+
+	if err := rs.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if err := rs.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 4 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want 4", len(mock.inputs))
+	}
+
+	want := map[string]string{"ZPUBLIC": "203.0.113.10", "ZPRIVATE": "10.0.0.1"}
+	got := map[string][]types.ChangeAction{}
+	for _, input := range mock.inputs {
+		zone := aws.ToString(input.HostedZoneId)
+		rrs := input.ChangeBatch.Changes[0].ResourceRecordSet
+		if value := aws.ToString(rrs.ResourceRecords[0].Value); value != want[zone] {
+			t.Errorf("zone %s got value %s, want %s", zone, value, want[zone])
+		}
+		got[zone] = append(got[zone], input.ChangeBatch.Changes[0].Action)
+	}
+	for zone := range want {
+		if actions := got[zone]; len(actions) != 2 || actions[0] != types.ChangeActionUpsert || actions[1] != types.ChangeActionDelete {
+			t.Errorf("zone %s got actions %v, want UPSERT then DELETE", zone, actions)
+		}
+	}
+}
+
+func Test_registerDeletesStaleRecords(t *testing.T) {
+	stale := testRegistrar(nil)
+	stale.IPAddress = "10.0.0.9"
+	staleRecord := stale.resourceRecordSet("my.example.com")
+
+	// Another identifier scheme, e.g. a task with an explicit -setidentifier, is left alone
+	other := testRegistrar(nil)
+	other.IPAddress = "10.0.0.8"
+	other.SetIdentifier = "blue"
+	otherRecord := other.resourceRecordSet("my.example.com")
+
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{
+		recordKey(staleRecord): *staleRecord,
+		recordKey(otherRecord): *otherRecord,
+	}}
+	r := testRegistrar(mock)
+	r.DeleteStale = true
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if len(mock.inputs) != 1 {
+		t.Fatalf("ChangeResourceRecordSets called %d times, want a single batch", len(mock.inputs))
+	}
+	changes := mock.inputs[0].ChangeBatch.Changes
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes, want the upsert and one delete", len(changes))
+	}
+	if changes[1].Action != types.ChangeActionDelete || aws.ToString(changes[1].ResourceRecordSet.SetIdentifier) != "10.0.0.9" {
+		t.Errorf("second change = %s %s, want DELETE of 10.0.0.9", changes[1].Action, aws.ToString(changes[1].ResourceRecordSet.SetIdentifier))
+	}
+	if _, ok := mock.records[recordKey(otherRecord)]; !ok {
+		t.Error("record with an explicit SetIdentifier was deleted")
+	}
+}
+
+func Test_registerDeletesStaleDualStackRecords(t *testing.T) {
+	stale := testRegistrar(nil)
+	stale.IPAddress = "10.0.0.9"
+	stale.IPv6Address = "2001:db8::9"
+	mock := &mockRoute53{records: map[string]types.ResourceRecordSet{}}
+	for _, change := range stale.changes(types.ChangeActionUpsert) {
+		mock.records[recordKey(change.ResourceRecordSet)] = *change.ResourceRecordSet
+	}
+	r := testRegistrar(mock)
+	r.IPv6Address = "2001:db8::1"
+	r.DeleteStale = true
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	for key, rrs := range mock.records {
+		if aws.ToString(rrs.SetIdentifier) == "10.0.0.9" {
+			t.Errorf("stale %s record %s was not deleted", rrs.Type, key)
+		}
+	}
+	if len(mock.records) != 2 {
+		t.Errorf("got %d records, want our A and AAAA records", len(mock.records))
+	}
+}
+
+func Test_RunRefreshTrigger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	trigger := make(chan struct{}, 1)
+	trigger <- struct{}{}
+	r.RefreshTrigger = trigger
+
+	if err := r.Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	var actions []types.ChangeAction
+	for _, input := range mock.inputs {
+		actions = append(actions, input.ChangeBatch.Changes[0].Action)
+	}
+	want := []types.ChangeAction{types.ChangeActionUpsert, types.ChangeActionUpsert, types.ChangeActionDelete}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("actions = %v, want %v", actions, want)
+	}
+}
+
+func Test_fastTeardown(t *testing.T) {
+	mock := &mockRoute53{pending: true}
+	r := testRegistrar(mock)
+	r.TTL = 60
+	r.FastTeardown = true
+
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatalf("Unregister() error = %v", err)
+	}
+	if len(mock.inputs) != 1 || mock.inputs[0].ChangeBatch.Changes[0].Action != types.ChangeActionDelete {
+		t.Fatalf("want a single DELETE batch, got %d batches", len(mock.inputs))
+	}
+	if mock.getChangeCalls != 0 {
+		t.Errorf("GetChange called %d times, want 0", mock.getChangeCalls)
+	}
+}
+
+func Test_perNameTTL(t *testing.T) {
+	r := testRegistrar(nil)
+	r.Names = []string{"failover.example.com", "cached.example.com"}
+	r.TTL = 300
+	r.TTLs = map[string]int{"failover.example.com": 5}
+
+	want := map[string]int64{"failover.example.com": 5, "cached.example.com": 300}
+	for _, change := range r.changes(types.ChangeActionUpsert) {
+		name := aws.ToString(change.ResourceRecordSet.Name)
+		if got := aws.ToInt64(change.ResourceRecordSet.TTL); got != want[name] {
+			t.Errorf("%s TTL = %d, want %d", name, got, want[name])
+		}
+	}
+	if got := r.maxTTL(); got != 300 {
+		t.Errorf("maxTTL() = %d, want 300", got)
+	}
+}
+
+func Test_waitForSyncFailures(t *testing.T) {
+	throttled := &types.ThrottlingException{Message: aws.String("Rate exceeded")}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   bool
+		wantCalls int
+	}{
+		{"throttled within the threshold", []error{throttled, throttled}, false, 3},
+		{"throttled beyond the threshold", []error{throttled, throttled, throttled}, true, 3},
+		{"hard error", []error{&types.NoSuchChange{Message: aws.String("no such change")}}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockRoute53{getChangeErrs: tt.errs}
+			r := testRegistrar(mock)
+			r.SyncMaxFailures = 2
+
+			err := r.Register(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mock.getChangeCalls != tt.wantCalls {
+				t.Errorf("GetChange called %d times, want %d", mock.getChangeCalls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_ptrRecord(t *testing.T) {
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.RecordType = types.RRTypePtr
+	r.RoutingPolicy = routingSimple
+	r.IPAddress = "1.2.3.4"
+	r.Names = []string{"my.example.com", "alias.example.com."}
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	changes := mock.inputs[0].ChangeBatch.Changes
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes, want a single PTR record set", len(changes))
+	}
+	rrs := changes[0].ResourceRecordSet
+	if rrs.Type != types.RRTypePtr || aws.ToString(rrs.Name) != "4.3.2.1.in-addr.arpa." {
+		t.Errorf("record = %s %s, want PTR 4.3.2.1.in-addr.arpa.", rrs.Type, aws.ToString(rrs.Name))
+	}
+	var values []string
+	for _, rr := range rrs.ResourceRecords {
+		values = append(values, aws.ToString(rr.Value))
+	}
+	if got := strings.Join(values, ","); got != "my.example.com.,alias.example.com." {
+		t.Errorf("values = %s, want both names", got)
+	}
+}
+
+func Test_refreshIPChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	resolves := 0
+	r.ResolveIP = func(context.Context) (string, error) {
+		resolves++
+		return "10.0.0.2", nil
+	}
+	trigger := make(chan struct{}, 1)
+	trigger <- struct{}{}
+	r.RefreshTrigger = trigger
+
+	if err := r.Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if resolves != 1 || len(mock.inputs) != 3 {
+		t.Fatalf("got %d resolves and %d change batches, want 1 and 3", resolves, len(mock.inputs))
+	}
+	var moved []string
+	for _, change := range mock.inputs[1].ChangeBatch.Changes {
+		moved = append(moved, string(change.Action)+" "+aws.ToString(change.ResourceRecordSet.ResourceRecords[0].Value))
+	}
+	if got := strings.Join(moved, ","); got != "DELETE 10.0.0.1,UPSERT 10.0.0.2" {
+		t.Errorf("refresh batch = %s, want the delete of the old and the upsert of the new address", got)
+	}
+	if got := aws.ToString(mock.inputs[2].ChangeBatch.Changes[0].ResourceRecordSet.ResourceRecords[0].Value); got != "10.0.0.2" {
+		t.Errorf("teardown deleted %s, want the new address", got)
+	}
+}
+
+func Test_refreshIPChangeDryRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.DryRun = true
+	resolves := 0
+	r.ResolveIP = func(context.Context) (string, error) {
+		resolves++
+		return "10.0.0.2", nil
+	}
+	trigger := make(chan struct{}, 1)
+	trigger <- struct{}{}
+	r.RefreshTrigger = trigger
+
+	if err := r.Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if resolves != 1 {
+		t.Fatalf("got %d resolves, want the refresh to move the address", resolves)
+	}
+	if len(mock.inputs) != 0 {
+		t.Errorf("ChangeResourceRecordSets called %d times on a dry run", len(mock.inputs))
+	}
+}
+
+func Test_refreshSerialized(t *testing.T) {
+	mock := &mockRoute53{delay: 20 * time.Millisecond}
+	r := testRegistrar(mock)
+
+	// A SIGHUP and the refresh ticker firing at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.upsert(context.Background()); err != nil {
+				t.Errorf("upsert() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(mock.inputs) != 2 {
+		t.Errorf("ChangeResourceRecordSets called %d times, want 2", len(mock.inputs))
+	}
+	if mock.maxInFlight != 1 {
+		t.Errorf("%d changes were in flight at once, want 1", mock.maxInFlight)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+)
+
+// isTransientError reports whether a Route53 error is worth retrying
+func isTransientError(err error) bool {
+	var priorRequest *types.PriorRequestNotComplete
+	var throttling *types.ThrottlingException
+	if errors.As(err, &priorRequest) || errors.As(err, &throttling) || errors.Is(err, errAPITimeout) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded", "PriorRequestNotComplete", "ProvisionedThroughputExceededException":
+			return true
+		}
+	}
+	return false
+}
+
+// errAPITimeout is returned by callWithTimeout when the call, not its parent context, timed out
+var errAPITimeout = errors.New("Route53 API call timed out")
+
+// callWithTimeout calls fn with a context bounded by timeout, 0 for none, so a hung connection fails
+// the call and the retry or poll loop can proceed
+func callWithTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(callCtx)
+	if err != nil && callCtx.Err() != nil && ctx.Err() == nil {
+		return fmt.Errorf("%w after %v: %w", errAPITimeout, timeout, err)
+	}
+	return err
+}
+
+// backoffDelay returns an exponential delay for the given attempt with up to 50% jitter
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << attempt
+	if delay <= 0 { // overflow
+		delay = base
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// jitter returns a random duration between 0 and limit
+func jitter(limit time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// retryWithBackoff calls fn until it succeeds, returns a non-retryable error or maxRetries is reached
+func retryWithBackoff(ctx context.Context, maxRetries int, base time.Duration, retryable func(error) bool, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt >= maxRetries {
+			return err
+		}
+
+		delay := backoffDelay(base, attempt)
+		log.Warnf("Attempt %d/%d failed, retrying in %v: %v", attempt+1, maxRetries+1, delay, err)
+		if err := SleepWithContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
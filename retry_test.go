@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+func Test_backoffDelay(t *testing.T) {
+	const base = 100 * time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		upper := base << attempt
+		got := backoffDelay(base, attempt)
+		if got < upper/2 || got > upper {
+			t.Errorf("backoffDelay(%v, %d) = %v, want between %v and %v", base, attempt, got, upper/2, upper)
+		}
+	}
+}
+
+func Test_jitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if got := jitter(10 * time.Millisecond); got < 0 || got > 10*time.Millisecond {
+			t.Fatalf("jitter(10ms) = %v, want between 0 and 10ms", got)
+		}
+	}
+}
+
+func Test_retryWithBackoff(t *testing.T) {
+	transient := &types.PriorRequestNotComplete{}
+	permanent := errors.New("permanent")
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", nil, 1, nil},
+		{"transient then success", []error{transient, transient}, 3, nil},
+		{"permanent", []error{permanent}, 1, permanent},
+		{"exhausted", []error{transient, transient, transient, transient}, 3, transient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			errs := tt.errs
+			err := retryWithBackoff(context.Background(), 2, time.Millisecond, isTransientError, func() error {
+				calls++
+				if len(errs) == 0 {
+					return nil
+				}
+				err := errs[0]
+				errs = errs[1:]
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("retryWithBackoff() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("retryWithBackoff() calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_callWithTimeout(t *testing.T) {
+	block := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err := callWithTimeout(context.Background(), 10*time.Millisecond, block)
+	if !errors.Is(err, errAPITimeout) || !isTransientError(err) {
+		t.Errorf("callWithTimeout() error = %v, want a transient %v", err, errAPITimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := callWithTimeout(ctx, time.Hour, block); errors.Is(err, errAPITimeout) || !errors.Is(err, context.Canceled) {
+		t.Errorf("callWithTimeout() with a cancelled parent error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func Test_retryWithBackoffCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := retryWithBackoff(ctx, 5, time.Hour, isTransientError, func() error {
+		return &types.ThrottlingException{}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("retryWithBackoff() error = %v, want %v", err, context.Canceled)
+	}
+}
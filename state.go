@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// zoneStateFile is the state file of a zone, each zone gets its own when registering in several
+func zoneStateFile(path, zone string, zones int) string {
+	if path == "" || zones < 2 {
+		return path
+	}
+	return path + "." + zone
+}
+
+// pendingChange is the -statefile content while a submitted change is not INSYNC yet
+type pendingChange struct {
+	ChangeID string `json:"changeId"`
+	Zone     string `json:"zone"`
+}
+
+// savePending records the submitted change in the state file so a restarted sidecar resumes waiting for it
+func (r *Registrar) savePending(changeSet *route53.ChangeResourceRecordSetsOutput) {
+	if r.StateFile == "" {
+		return
+	}
+	data, err := json.Marshal(pendingChange{ChangeID: aws.ToString(changeSet.ChangeInfo.Id), Zone: r.HostedZone})
+	if err == nil {
+		err = os.WriteFile(r.StateFile, data, 0o600)
+	}
+	if err != nil {
+		r.logger().Warnf("Unable to write the state file: %v", err)
+	}
+}
+
+// clearPending removes the state file once the change is INSYNC
+func (r *Registrar) clearPending() {
+	if r.StateFile == "" {
+		return
+	}
+	if err := os.Remove(r.StateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		r.logger().Warnf("Unable to remove the state file: %v", err)
+	}
+}
+
+// resumePending waits for a change a previous run submitted but did not see INSYNC, before changing anything else
+func (r *Registrar) resumePending(ctx context.Context) error {
+	if r.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(r.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var pending pendingChange
+	if err := json.Unmarshal(data, &pending); err != nil || pending.ChangeID == "" || pending.Zone != r.HostedZone {
+		r.logger().Warnf("Ignoring the state file %s, it holds no pending change of this zone", r.StateFile)
+		r.clearPending()
+		return nil
+	}
+
+	r.logger().With("changeId", pending.ChangeID).Info("Resuming the wait for a change submitted before the restart")
+	err = r.waitForSync(ctx, &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &types.ChangeInfo{Id: aws.String(pending.ChangeID)},
+	})
+	if err != nil && ctx.Err() == nil {
+		r.clearPending() // e.g. the change expired, do not get stuck on it after every restart
+	}
+	return err
+}
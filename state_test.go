@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_resumePendingChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"changeId":"/change/CPREVIOUS","zone":"Z123"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.StateFile = path
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	if len(mock.getChangeIDs) != 2 || mock.getChangeIDs[0] != "/change/CPREVIOUS" || mock.getChangeIDs[1] != "C123" {
+		t.Errorf("polled changes %v, want the previous change before the new one", mock.getChangeIDs)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file still exists after INSYNC: %v", err)
+	}
+}
+
+func Test_statePendingUntilInsync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	mock := &mockRoute53{}
+	r := testRegistrar(mock)
+	r.StateFile = path
+	r.Wait = false
+
+	if err := r.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != `{"changeId":"C123","zone":"Z123"}` {
+		t.Errorf("state file = %s, %v, want the pending change", data, err)
+	}
+}
+
+func Test_zoneStateFile(t *testing.T) {
+	if got := zoneStateFile("/tmp/state", "ZPUBLIC", 2); got != "/tmp/state.ZPUBLIC" {
+		t.Errorf("zoneStateFile() = %q", got)
+	}
+	if got := zoneStateFile("/tmp/state", "ZPUBLIC", 1); got != "/tmp/state" {
+		t.Errorf("zoneStateFile() of a single zone = %q", got)
+	}
+}
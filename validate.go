@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// maxTTL is the largest TTL Route53 accepts, in seconds
+const maxTTL = 2147483647
+
+// validate checks the resolved configuration before any change batch is built
+func (r *Registrar) validate() error {
+	if len(r.Names) == 0 {
+		return errors.New("invalid -dns: no DNS name given")
+	}
+	for _, name := range r.Names {
+		if err := validateDomainName(name); err != nil {
+			return fmt.Errorf("invalid -dns %q: %w", name, err)
+		}
+	}
+
+	// Route53 accepts 0, resolvers then do not cache and teardown has nothing to wait for
+	if r.TTL < 0 || r.TTL > maxTTL {
+		return fmt.Errorf("invalid -dnsttl %d: must be between 0 and %d seconds", r.TTL, maxTTL)
+	}
+	for name, ttl := range r.TTLs {
+		if ttl < 0 || ttl > maxTTL {
+			return fmt.Errorf("invalid -dns TTL %d of %s: must be between 0 and %d seconds", ttl, name, maxTTL)
+		}
+	}
+	if r.MinTTL < 0 || r.MinTTL > maxTTL {
+		return fmt.Errorf("invalid -minttl %d: must be between 0 and %d seconds", r.MinTTL, maxTTL)
+	}
+	if r.RejectLowTTL {
+		if r.TTL < r.MinTTL {
+			return fmt.Errorf("invalid -dnsttl %d: below -minttl %d seconds", r.TTL, r.MinTTL)
+		}
+		for name, ttl := range r.TTLs {
+			if ttl < r.MinTTL {
+				return fmt.Errorf("invalid -dns TTL %d of %s: below -minttl %d seconds", ttl, name, r.MinTTL)
+			}
+		}
+	}
+
+	if r.DeleteStale && (r.SetIdentifier != "" || r.RoutingPolicy == routingSimple) {
+		return errors.New("invalid -deletestale: stale records are only recognized with the default -setidentifier and a routing policy other than simple")
+	}
+
+	if r.AliasTarget != "" {
+		if err := validateDomainName(r.AliasTarget); err != nil {
+			return fmt.Errorf("invalid -aliastarget %q: %w", r.AliasTarget, err)
+		}
+		if r.AliasZone == "" {
+			return errors.New("invalid -aliaszone: empty hosted zone ID")
+		}
+		return nil
+	}
+	switch types.RRType(strings.ToUpper(string(r.RecordType))) {
+	case types.RRTypeCname:
+		if err := validateDomainName(r.Target); err != nil {
+			return fmt.Errorf("invalid -target %q: %w", r.Target, err)
+		}
+		return nil
+	case types.RRTypeSrv:
+		if err := validateDomainName(r.Target); err != nil {
+			return fmt.Errorf("invalid -target %q: %w", r.Target, err)
+		}
+		if r.SRVPort < 1 || r.SRVPort > 65535 {
+			return fmt.Errorf("invalid -srvport %d: must be between 1 and 65535", r.SRVPort)
+		}
+		if r.SRVPriority < 0 || r.SRVPriority > 65535 {
+			return fmt.Errorf("invalid -srvpriority %d: must be between 0 and 65535", r.SRVPriority)
+		}
+		if r.SRVWeight < 0 || r.SRVWeight > 65535 {
+			return fmt.Errorf("invalid -srvweight %d: must be between 0 and 65535", r.SRVWeight)
+		}
+		return nil
+	}
+	if r.IPAddress == "" {
+		return errors.New("invalid -ipaddress: empty IP address")
+	}
+	if len(r.ExtraIPAddresses) > 0 && types.RRType(strings.ToUpper(string(r.RecordType))) == types.RRTypePtr {
+		return errors.New("invalid -ipaddress: a PTR record is for a single address")
+	}
+	if types.RRType(strings.ToUpper(string(r.RecordType))) == types.RRTypePtr && r.TXTValue != "" {
+		return errors.New("invalid -txtvalue: PTR records live in the reverse zone, which does not hold the TXT records of the names")
+	}
+	addr := net.ParseIP(r.IPAddress)
+	if addr == nil {
+		return fmt.Errorf("invalid -ipaddress %q: not an IP address", r.IPAddress)
+	}
+	seen := map[string]bool{addr.String(): true}
+	for _, ip := range r.ExtraIPAddresses {
+		extra := net.ParseIP(ip)
+		if extra == nil {
+			return fmt.Errorf("invalid -ipaddress %q: not an IP address", ip)
+		}
+		if (extra.To4() == nil) != (addr.To4() == nil) {
+			return fmt.Errorf("invalid -ipaddress %q: the addresses of a record must all be IPv4 or all IPv6", ip)
+		}
+		if seen[extra.String()] {
+			return fmt.Errorf("invalid -ipaddress %q: listed more than once", ip)
+		}
+		seen[extra.String()] = true
+	}
+	if r.IPv6Address != "" {
+		if ip := net.ParseIP(r.IPv6Address); ip == nil || ip.To4() != nil || addr.To4() == nil {
+			return fmt.Errorf("invalid -dualstack: want an IPv4 and an IPv6 address, got %q and %q", r.IPAddress, r.IPv6Address)
+		}
+	}
+	return nil
+}
+
+// validateDomainName checks name is a fully qualified domain name, the trailing dot is optional
+func validateDomainName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return errors.New("empty domain name")
+	}
+	if len(name) > 253 {
+		return errors.New("domain name longer than 253 characters")
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return errors.New("not a fully qualified domain name")
+	}
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			continue // wildcard records
+		}
+		if err := validateLabel(label); err != nil {
+			return fmt.Errorf("label %q: %w", label, err)
+		}
+	}
+	return nil
+}
+
+func validateLabel(label string) error {
+	if len(label) == 0 || len(label) > 63 {
+		return errors.New("must be between 1 and 63 characters")
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return errors.New("must not start or end with a hyphen")
+	}
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+func Test_validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		dns        string
+		ipAddress  string
+		recordType string
+		target     string
+		wantErr    string
+	}{
+		{"valid", "my.example.com.", "10.0.0.1", "A", "", ""},
+		{"missing trailing dot", "my.example.com", "10.0.0.1", "A", "", ""},
+		{"valid ipv6", "my.example.com", "2001:db8::1", "AAAA", "", ""},
+		{"multiple names", "a.example.com,b.example.com", "10.0.0.1", "A", "", ""},
+		{"wildcard", "*.example.com", "10.0.0.1", "A", "", ""},
+		{"empty ip", "my.example.com", "", "A", "", "-ipaddress"},
+		{"malformed ip", "my.example.com", "10.0.0.300", "A", "", "-ipaddress"},
+		{"metadata sentinel", "my.example.com", "public-ipv4", "AUTO", "", "-ipaddress"},
+		{"empty dns", "", "10.0.0.1", "A", "", "-dns"},
+		{"short name", "api", "10.0.0.1", "A", "", "-dns"},
+		{"bad label", "my_host-.example.com", "10.0.0.1", "A", "", "-dns"},
+		{"bad character", "my host.example.com", "10.0.0.1", "A", "", "-dns"},
+		{"cname", "www.example.com", "", "CNAME", "lb.example.com", ""},
+		{"cname bad target", "www.example.com", "", "CNAME", "lb", "-target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns = tt.dns
+			r := &Registrar{Names: dnsNames(), IPAddress: tt.ipAddress, RecordType: types.RRType(tt.recordType), Target: tt.target}
+			err := r.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want error naming %s", err, tt.wantErr)
+			}
+		})
+	}
+	dns = "my.example.com"
+}
+
+func Test_validateMultipleIPs(t *testing.T) {
+	tests := []struct {
+		recordType types.RRType
+		ip         string
+		extra      []string
+		wantErr    bool
+	}{
+		{types.RRTypeA, "10.0.0.1", []string{"10.0.1.1", "10.0.2.1"}, false},
+		{types.RRTypeAaaa, "2001:db8::1", []string{"2001:db8::2"}, false},
+		{types.RRTypeA, "10.0.0.1", []string{"2001:db8::2"}, true},
+		{types.RRTypeA, "10.0.0.1", []string{"10.0.0.1"}, true},
+		{types.RRTypeA, "10.0.0.1", []string{"not-an-ip"}, true},
+		{types.RRTypePtr, "10.0.0.1", []string{"10.0.1.1"}, true},
+	}
+	for _, tt := range tests {
+		r := &Registrar{Names: []string{"my.example.com"}, IPAddress: tt.ip, ExtraIPAddresses: tt.extra, RecordType: tt.recordType}
+		if err := r.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() of %s %s %v error = %v, wantErr %v", tt.recordType, tt.ip, tt.extra, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_validateMinTTL(t *testing.T) {
+	r := &Registrar{Names: []string{"my.example.com"}, IPAddress: "10.0.0.1", RecordType: types.RRTypeA, TTL: 5, MinTTL: 30}
+	if err := r.validate(); err != nil {
+		t.Errorf("validate() error = %v, want the TTL raised", err)
+	}
+	r.RejectLowTTL = true
+	if err := r.validate(); err == nil || !strings.Contains(err.Error(), "-minttl") {
+		t.Errorf("validate() error = %v, want error naming -minttl", err)
+	}
+	r.TTL = 30
+	r.TTLs = map[string]int{"my.example.com": 10}
+	if err := r.validate(); err == nil || !strings.Contains(err.Error(), "my.example.com") {
+		t.Errorf("validate() error = %v, want the name with the low TTL", err)
+	}
+}
+
+func Test_validateTTL(t *testing.T) {
+	tests := []struct {
+		ttl     int
+		wantErr bool
+	}{
+		{10, false},
+		{0, false},
+		{maxTTL, false},
+		{-1, true},
+	}
+	for _, tt := range tests {
+		r := &Registrar{Names: []string{"my.example.com"}, IPAddress: "10.0.0.1", RecordType: types.RRTypeA, TTL: tt.ttl}
+		err := r.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate() with TTL %d error = %v, wantErr %v", tt.ttl, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "-dnsttl") {
+			t.Errorf("validate() error = %v, want error naming -dnsttl", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookTimeout bounds each webhook request, a slow receiver must not hold up the sidecar
+var webhookTimeout = 5 * time.Second
+
+// webhookEvent is the JSON payload posted to -webhook after a successful registration or teardown
+type webhookEvent struct {
+	Action    string    `json:"action"` // register or deregister
+	DNS       []string  `json:"dns"`
+	IP        string    `json:"ip"`
+	Zone      string    `json:"zone"`
+	ChangeID  string    `json:"changeId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// notify posts the event to the webhook in the background, failures are only logged.
+// Unregister waits for the pending notifications before returning.
+func (r *Registrar) notify(action, changeID string) {
+	if r.Webhook == "" {
+		return
+	}
+	event := webhookEvent{
+		Action:    action,
+		DNS:       r.Names,
+		IP:        r.recordValue(),
+		Zone:      r.HostedZone,
+		ChangeID:  changeID,
+		Timestamp: time.Now().UTC(),
+	}
+	r.webhooks.Add(1)
+	go func() {
+		defer r.webhooks.Done()
+		if err := postWebhook(r.Webhook, event); err != nil {
+			r.logger().Warnf("Failed to notify the webhook of the %s: %v", action, err)
+		}
+	}()
+}
+
+// waitWebhooks waits for the pending notifications of every registrar, e.g. before exiting after -register
+func (rs registrars) waitWebhooks() {
+	for _, r := range rs {
+		r.webhooks.Wait()
+	}
+}
+
+func postWebhook(url string, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// redactURL drops the credentials, path and query of a webhook URL for logging, they often hold a secret token
+func redactURL(url string) string {
+	if url == "" {
+		return ""
+	}
+	if scheme, rest, ok := strings.Cut(url, "://"); ok {
+		host, _, _ := strings.Cut(rest, "/")
+		if i := strings.LastIndexByte(host, '@'); i >= 0 {
+			host = host[i+1:]
+		}
+		return scheme + "://" + host + "/..."
+	}
+	return "..."
+}